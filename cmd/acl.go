@@ -0,0 +1,166 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// ACL options for uploaded objects. Grants use the S3 header syntax, e.g.
+// `id="<canonical user id>"` or `uri="http://acs.amazonaws.com/groups/global/AllUsers"`,
+// with several grantees separated by commas.
+var (
+	cannedACL        string
+	grantRead        string
+	grantReadACP     string
+	grantWriteACP    string
+	grantFullControl string
+)
+
+func validateACLOptions() error {
+	if cannedACL == "" {
+		return nil
+	}
+	// S3 rejects requests that carry both a canned ACL and explicit grants
+	if grantRead != "" || grantReadACP != "" || grantWriteACP != "" || grantFullControl != "" {
+		return fmt.Errorf("--acl cannot be combined with --grant-* options")
+	}
+	for _, value := range s3.ObjectCannedACL_Values() {
+		if cannedACL == value {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid --acl %q (want one of %s)", cannedACL, strings.Join(s3.ObjectCannedACL_Values(), ", "))
+}
+
+// aclsRequested reports whether any option needs the bucket to accept ACLs.
+// bucket-owner-full-control is accepted even when ACLs are disabled.
+func aclsRequested() bool {
+	return (cannedACL != "" && cannedACL != s3.ObjectCannedACLBucketOwnerFullControl) ||
+		grantRead != "" || grantReadACP != "" || grantWriteACP != "" || grantFullControl != ""
+}
+
+// checkBucketACLs fails early when ACL options are given for a bucket whose
+// Object Ownership setting is BucketOwnerEnforced, which rejects every upload
+// that carries an ACL. If the setting cannot be read the check is skipped.
+func checkBucketACLs(s3Client *s3.S3, bucketName string) error {
+	if !aclsRequested() {
+		return nil
+	}
+
+	output, err := s3Client.GetBucketOwnershipControls(&s3.GetBucketOwnershipControlsInput{
+		Bucket: aws.String(bucketName),
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "OwnershipControlsNotFoundError" {
+			// No ownership controls: ACLs are enabled
+			return nil
+		}
+		fmt.Printf("Warning: could not read object ownership of bucket %s: %v\n", bucketName, err)
+		return nil
+	}
+
+	if output.OwnershipControls == nil {
+		return nil
+	}
+	for _, rule := range output.OwnershipControls.Rules {
+		if aws.StringValue(rule.ObjectOwnership) == s3.ObjectOwnershipBucketOwnerEnforced {
+			return fmt.Errorf("bucket %s has ACLs disabled (Object Ownership is BucketOwnerEnforced); "+
+				"remove --acl and --grant-* options or use --acl bucket-owner-full-control, "+
+				"and control access with a bucket policy instead", bucketName)
+		}
+	}
+	return nil
+}
+
+func applyACL(input *s3.PutObjectInput) {
+	if cannedACL != "" {
+		input.ACL = aws.String(cannedACL)
+	}
+	if grantRead != "" {
+		input.GrantRead = aws.String(grantRead)
+	}
+	if grantReadACP != "" {
+		input.GrantReadACP = aws.String(grantReadACP)
+	}
+	if grantWriteACP != "" {
+		input.GrantWriteACP = aws.String(grantWriteACP)
+	}
+	if grantFullControl != "" {
+		input.GrantFullControl = aws.String(grantFullControl)
+	}
+}
+
+// applySidecarACL sets the ACL of an internal object such as an attribute
+// sidecar. These stay private whatever the uploaded objects are shared with;
+// only bucket-owner-full-control is passed on so the bucket owner can still
+// read them.
+func applySidecarACL(input *s3.PutObjectInput) {
+	if cannedACL == s3.ObjectCannedACLBucketOwnerFullControl {
+		input.ACL = aws.String(cannedACL)
+	}
+}
+
+// applyACLToCopy sets the ACL options on a copy, which does not keep the
+// source object's ACL.
+func applyACLToCopy(input *s3.CopyObjectInput) {
+	if cannedACL != "" {
+		input.ACL = aws.String(cannedACL)
+	}
+	if grantRead != "" {
+		input.GrantRead = aws.String(grantRead)
+	}
+	if grantReadACP != "" {
+		input.GrantReadACP = aws.String(grantReadACP)
+	}
+	if grantWriteACP != "" {
+		input.GrantWriteACP = aws.String(grantWriteACP)
+	}
+	if grantFullControl != "" {
+		input.GrantFullControl = aws.String(grantFullControl)
+	}
+}
+
+// copyObjectACL gives a copy the ACL of its source, since copies start out
+// private. ACLs that only grant the owner full control need no change, which
+// also keeps this working on buckets with ACLs disabled.
+func copyObjectACL(s3Client *s3.S3, bucketName, sourceKey string, sourceVersion *string, key string) error {
+	acl, err := s3Client.GetObjectAcl(&s3.GetObjectAclInput{
+		Bucket:    aws.String(bucketName),
+		Key:       aws.String(sourceKey),
+		VersionId: sourceVersion,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to read ACL: %v", err)
+	}
+
+	ownerID := ""
+	if acl.Owner != nil {
+		ownerID = aws.StringValue(acl.Owner.ID)
+	}
+	private := true
+	for _, grant := range acl.Grants {
+		if grant.Grantee == nil || aws.StringValue(grant.Grantee.ID) != ownerID || aws.StringValue(grant.Permission) != s3.PermissionFullControl {
+			private = false
+		}
+	}
+	if private {
+		return nil
+	}
+
+	_, err = s3Client.PutObjectAcl(&s3.PutObjectAclInput{
+		Bucket: aws.String(bucketName),
+		Key:    aws.String(key),
+		AccessControlPolicy: &s3.AccessControlPolicy{
+			Owner:  acl.Owner,
+			Grants: acl.Grants,
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to set ACL: %v", err)
+	}
+	return nil
+}
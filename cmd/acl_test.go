@@ -0,0 +1,87 @@
+package cmd
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func resetACLFlags() {
+	cannedACL, grantRead, grantReadACP, grantWriteACP, grantFullControl = "", "", "", "", ""
+}
+
+func TestCheckBucketACLs(t *testing.T) {
+	defer resetACLFlags()
+
+	ownership := map[string]string{
+		"/enforced":  "BucketOwnerEnforced",
+		"/preferred": "BucketOwnerPreferred",
+	}
+	requests := 0
+	client := newFakeS3Client(t, func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if _, ok := r.URL.Query()["ownershipControls"]; !ok {
+			t.Errorf("Unexpected request %s %s", r.Method, r.URL)
+		}
+		value, ok := ownership[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`<Error><Code>OwnershipControlsNotFoundError</Code><Message>none</Message></Error>`))
+			return
+		}
+		w.Write([]byte(`<OwnershipControls><Rule><ObjectOwnership>` + value + `</ObjectOwnership></Rule></OwnershipControls>`))
+	})
+
+	if err := checkBucketACLs(client, "enforced"); err != nil || requests != 0 {
+		t.Errorf("Expected no check without ACL options: %v, %d requests", err, requests)
+	}
+
+	cannedACL = "bucket-owner-full-control"
+	if err := checkBucketACLs(client, "enforced"); err != nil || requests != 0 {
+		t.Errorf("Expected bucket-owner-full-control to be allowed without a check: %v", err)
+	}
+
+	cannedACL = "public-read"
+	err := checkBucketACLs(client, "enforced")
+	if err == nil || !strings.Contains(err.Error(), "BucketOwnerEnforced") {
+		t.Errorf("Expected a clear error for BucketOwnerEnforced, got %v", err)
+	}
+	for _, bucket := range []string{"preferred", "legacy"} {
+		if err := checkBucketACLs(client, bucket); err != nil {
+			t.Errorf("Expected bucket %s to accept ACLs, got %v", bucket, err)
+		}
+	}
+
+	resetACLFlags()
+	grantRead = `uri="http://acs.amazonaws.com/groups/global/AllUsers"`
+	if err := checkBucketACLs(client, "enforced"); err == nil {
+		t.Errorf("Expected grants to be rejected for BucketOwnerEnforced")
+	}
+
+	cannedACL = "public-read"
+	if err := validateACLOptions(); err == nil {
+		t.Errorf("Expected --acl with --grant-read to be rejected")
+	}
+
+	resetACLFlags()
+	cannedACL = "world-writable"
+	if err := validateACLOptions(); err == nil {
+		t.Errorf("Expected an unknown canned ACL to be rejected")
+	}
+}
+
+func TestApplySidecarACL(t *testing.T) {
+	defer resetACLFlags()
+
+	for acl, want := range map[string]string{"public-read": "", "bucket-owner-full-control": "bucket-owner-full-control"} {
+		cannedACL = acl
+		input := &s3.PutObjectInput{}
+		applySidecarACL(input)
+		if aws.StringValue(input.ACL) != want || input.GrantRead != nil {
+			t.Errorf("--acl %s: expected sidecar ACL %q, got %q", acl, want, aws.StringValue(input.ACL))
+		}
+	}
+}
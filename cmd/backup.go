@@ -0,0 +1,120 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var backupDir string
+
+// localBackup moves local files that a download replaces or deletes into a
+// directory per run under --backup-dir, instead of losing them.
+type localBackup struct {
+	root string
+	dir  string
+}
+
+// newLocalBackup prepares the backups of a download into root. Without
+// --backup-dir it returns nil, and files are replaced and deleted as usual.
+func newLocalBackup(root string, startedAt time.Time) (*localBackup, error) {
+	if backupDir == "" {
+		return nil, nil
+	}
+
+	absRoot, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	absBackup, err := filepath.Abs(backupDir)
+	if err != nil {
+		return nil, err
+	}
+	// Backups inside the output directory would be synced like any other file
+	if rel, err := filepath.Rel(absRoot, absBackup); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return nil, fmt.Errorf("--backup-dir must be outside the output directory")
+	}
+
+	return &localBackup{root: root, dir: filepath.Join(backupDir, newRunID(startedAt))}, nil
+}
+
+// save moves the file at relativePath out of the way, keeping its place in
+// the tree. It returns where the file went, or "" if there was none.
+func (b *localBackup) save(relativePath string) (string, error) {
+	src := filepath.Join(b.root, relativePath)
+	info, err := os.Lstat(src)
+	if os.IsNotExist(err) || (err == nil && info.IsDir()) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	dst := filepath.Join(b.dir, relativePath)
+	if err := os.MkdirAll(filepath.Dir(dst), os.ModePerm); err != nil {
+		return "", err
+	}
+	if err := os.Rename(src, dst); err == nil {
+		return dst, nil
+	}
+
+	// Renaming fails across file systems, so copy the file instead
+	if err := copyLocalFile(src, dst, info); err != nil {
+		os.Remove(dst)
+		return "", err
+	}
+	return dst, os.Remove(src)
+}
+
+// keep saves the local file at localFilePath, which lies under the root, and
+// reports where it went. It does nothing without --backup-dir.
+func (b *localBackup) keep(localFilePath string) error {
+	if b == nil {
+		return nil
+	}
+	relativePath, err := filepath.Rel(b.root, localFilePath)
+	if err != nil {
+		return err
+	}
+	saved, err := b.save(relativePath)
+	if err != nil {
+		return fmt.Errorf("failed to back up local file %s: %v", filepath.ToSlash(relativePath), err)
+	}
+	if saved != "" {
+		fmt.Printf("Backed up %s to %s\n", filepath.ToSlash(relativePath), saved)
+	}
+	return nil
+}
+
+// copyLocalFile copies a regular file or symlink, keeping its mode and mtime.
+func copyLocalFile(src, dst string, info os.FileInfo) error {
+	if info.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(src)
+		if err != nil {
+			return err
+		}
+		return os.Symlink(target, dst)
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Chtimes(dst, info.ModTime(), info.ModTime())
+}
@@ -0,0 +1,81 @@
+package cmd
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLocalBackup(t *testing.T) {
+	defer func() { backupDir = "" }()
+
+	root := t.TempDir()
+	backupDir = filepath.Join(root, "backups")
+	if _, err := newLocalBackup(root, time.Now()); err == nil {
+		t.Errorf("Expected a backup directory inside the output directory to be rejected")
+	}
+
+	backupDir = ""
+	if backups, err := newLocalBackup(root, time.Now()); backups != nil || err != nil {
+		t.Errorf("Expected no backups without --backup-dir: %v, %v", backups, err)
+	}
+
+	backupDir = t.TempDir()
+	backups, err := newLocalBackup(root, time.Now())
+	if err != nil {
+		t.Fatalf("newLocalBackup failed: %v", err)
+	}
+
+	os.MkdirAll(filepath.Join(root, "docs"), 0755)
+	os.WriteFile(filepath.Join(root, "docs", "a.txt"), []byte("old"), 0640)
+
+	saved, err := backups.save(filepath.Join("docs", "a.txt"))
+	if err != nil {
+		t.Fatalf("save failed: %v", err)
+	}
+	if !strings.HasPrefix(saved, backupDir) || !strings.HasSuffix(saved, filepath.Join("docs", "a.txt")) {
+		t.Errorf("Unexpected backup path %s", saved)
+	}
+	if data, err := os.ReadFile(saved); err != nil || string(data) != "old" {
+		t.Errorf("Expected the old content to be backed up: %q, %v", data, err)
+	}
+	if _, err := os.Lstat(filepath.Join(root, "docs", "a.txt")); !os.IsNotExist(err) {
+		t.Errorf("Expected the file to be moved away, got %v", err)
+	}
+
+	if saved, err := backups.save("missing.txt"); saved != "" || err != nil {
+		t.Errorf("Expected nothing to back up for a missing file: %q, %v", saved, err)
+	}
+}
+
+func TestDownloadSkippedSymlinkKeepsLocalFile(t *testing.T) {
+	defer func() { backupDir = "" }()
+
+	client := newFakeS3Client(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Amz-Meta-S3sync-Symlink", "target.txt")
+		w.Write([]byte("target.txt"))
+	})
+
+	root := t.TempDir()
+	backupDir = t.TempDir()
+	backups, err := newLocalBackup(root, time.Now())
+	if err != nil {
+		t.Fatalf("newLocalBackup failed: %v", err)
+	}
+	localPath := filepath.Join(root, "link.txt")
+	os.WriteFile(localPath, []byte("local"), 0644)
+
+	// Without --symlinks=preserve nothing replaces the file, so it stays
+	if err := downloadFile(client, "bucket", "link.txt", localPath, backups); err != errSymlinkSkipped {
+		t.Fatalf("Expected the symlink to be skipped, got %v", err)
+	}
+	if data, err := os.ReadFile(localPath); err != nil || string(data) != "local" {
+		t.Errorf("Expected the local file to be left in place: %q, %v", data, err)
+	}
+	if _, err := os.Stat(backups.dir); !os.IsNotExist(err) {
+		t.Errorf("Expected nothing to be backed up, got %v", err)
+	}
+}
@@ -0,0 +1,141 @@
+package cmd
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+var (
+	createBucket      bool
+	bucketEncryption  string
+	bucketKMSKeyID    string
+	bucketVersioning  bool
+	blockPublicAccess bool
+)
+
+func init() {
+	uploadCmd.Flags().BoolVar(&createBucket, "create-bucket", false, "Create the bucket if it does not exist")
+	uploadCmd.Flags().StringVar(&bucketEncryption, "bucket-encryption", "", "Default encryption for a bucket created with --create-bucket: AES256 or aws:kms")
+	uploadCmd.Flags().StringVar(&bucketKMSKeyID, "bucket-kms-key-id", "", "KMS key for --bucket-encryption aws:kms (default: the AWS managed key)")
+	uploadCmd.Flags().BoolVar(&bucketVersioning, "bucket-versioning", false, "Enable versioning on a bucket created with --create-bucket")
+	uploadCmd.Flags().BoolVar(&blockPublicAccess, "block-public-access", false, "Block all public access to a bucket created with --create-bucket")
+}
+
+func validateBucketOptions() error {
+	switch bucketEncryption {
+	case "", s3.ServerSideEncryptionAes256, s3.ServerSideEncryptionAwsKms:
+	default:
+		return fmt.Errorf("invalid --bucket-encryption %q (want AES256 or aws:kms)", bucketEncryption)
+	}
+	if bucketKMSKeyID != "" && bucketEncryption != s3.ServerSideEncryptionAwsKms {
+		return fmt.Errorf("--bucket-kms-key-id requires --bucket-encryption aws:kms")
+	}
+	if !createBucket && (bucketEncryption != "" || bucketVersioning || blockPublicAccess) {
+		return fmt.Errorf("--bucket-encryption, --bucket-versioning and --block-public-access only apply with --create-bucket")
+	}
+	return nil
+}
+
+// ensureBucket checks that the bucket can be used and, with --create-bucket,
+// creates it if it does not exist. Only a missing bucket is created: a
+// bucket that exists but cannot be accessed is reported as such.
+func ensureBucket(s3Client *s3.S3, bucketName string) error {
+	_, err := s3Client.HeadBucket(&s3.HeadBucketInput{
+		Bucket: aws.String(bucketName),
+	})
+	if err == nil {
+		return nil
+	}
+
+	reqErr, ok := err.(awserr.RequestFailure)
+	if !ok {
+		return fmt.Errorf("failed to access bucket: %v", err)
+	}
+	switch reqErr.StatusCode() {
+	case http.StatusNotFound:
+		if !createBucket {
+			return fmt.Errorf("bucket %s does not exist (pass --create-bucket to create it)", bucketName)
+		}
+		return createConfiguredBucket(s3Client, bucketName)
+	case http.StatusForbidden:
+		return fmt.Errorf("access to bucket %s denied: it belongs to another account or the credentials lack s3:ListBucket on it", bucketName)
+	case http.StatusMovedPermanently:
+		return fmt.Errorf("bucket %s is not in region %s; set --region to the bucket's region", bucketName, aws.StringValue(s3Client.Config.Region))
+	}
+	return fmt.Errorf("failed to access bucket: %v", err)
+}
+
+// createConfiguredBucket creates the bucket in the client's region and
+// applies the requested public access block, default encryption and
+// versioning.
+func createConfiguredBucket(s3Client *s3.S3, bucketName string) error {
+	input := &s3.CreateBucketInput{
+		Bucket: aws.String(bucketName),
+	}
+	// us-east-1 is the default location and must not be named explicitly
+	if region := aws.StringValue(s3Client.Config.Region); region != "" && region != "us-east-1" {
+		input.CreateBucketConfiguration = &s3.CreateBucketConfiguration{
+			LocationConstraint: aws.String(region),
+		}
+	}
+
+	_, err := s3Client.CreateBucket(input)
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeBucketAlreadyExists {
+		return fmt.Errorf("bucket name %s is already taken by another account", bucketName)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create bucket: %v", err)
+	}
+	fmt.Printf("Created bucket %s\n", bucketName)
+
+	if blockPublicAccess {
+		_, err := s3Client.PutPublicAccessBlock(&s3.PutPublicAccessBlockInput{
+			Bucket: aws.String(bucketName),
+			PublicAccessBlockConfiguration: &s3.PublicAccessBlockConfiguration{
+				BlockPublicAcls:       aws.Bool(true),
+				IgnorePublicAcls:      aws.Bool(true),
+				BlockPublicPolicy:     aws.Bool(true),
+				RestrictPublicBuckets: aws.Bool(true),
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to block public access to bucket: %v", err)
+		}
+	}
+
+	if bucketEncryption != "" {
+		rule := &s3.ServerSideEncryptionByDefault{
+			SSEAlgorithm: aws.String(bucketEncryption),
+		}
+		if bucketKMSKeyID != "" {
+			rule.KMSMasterKeyID = aws.String(bucketKMSKeyID)
+		}
+		_, err := s3Client.PutBucketEncryption(&s3.PutBucketEncryptionInput{
+			Bucket: aws.String(bucketName),
+			ServerSideEncryptionConfiguration: &s3.ServerSideEncryptionConfiguration{
+				Rules: []*s3.ServerSideEncryptionRule{{ApplyServerSideEncryptionByDefault: rule}},
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to set default encryption on bucket: %v", err)
+		}
+	}
+
+	if bucketVersioning {
+		_, err := s3Client.PutBucketVersioning(&s3.PutBucketVersioningInput{
+			Bucket: aws.String(bucketName),
+			VersioningConfiguration: &s3.VersioningConfiguration{
+				Status: aws.String(s3.BucketVersioningStatusEnabled),
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to enable versioning on bucket: %v", err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,97 @@
+package cmd
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+func resetBucketFlags() {
+	createBucket, bucketEncryption, bucketKMSKeyID, bucketVersioning, blockPublicAccess = false, "", "", false, false
+}
+
+func TestValidateBucketOptions(t *testing.T) {
+	defer resetBucketFlags()
+
+	bucketVersioning = true
+	if err := validateBucketOptions(); err == nil {
+		t.Errorf("Expected --bucket-versioning without --create-bucket to be rejected")
+	}
+	createBucket, bucketEncryption = true, "aws:kms:dsse"
+	if err := validateBucketOptions(); err == nil {
+		t.Errorf("Expected an unsupported --bucket-encryption to be rejected")
+	}
+	bucketEncryption, bucketKMSKeyID = "AES256", "key"
+	if err := validateBucketOptions(); err == nil {
+		t.Errorf("Expected --bucket-kms-key-id without aws:kms to be rejected")
+	}
+	bucketEncryption = "aws:kms"
+	if err := validateBucketOptions(); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestEnsureBucket(t *testing.T) {
+	defer resetBucketFlags()
+
+	var headStatus int
+	var requests []string
+	var createBody string
+	client := newFakeS3Client(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			w.WriteHeader(headStatus)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		if r.Method != http.MethodPut || r.URL.Path != "/bucket" {
+			t.Errorf("Unexpected request %s %s", r.Method, r.URL)
+		}
+		switch {
+		case r.URL.RawQuery == "":
+			createBody = string(body)
+			requests = append(requests, "create")
+		default:
+			requests = append(requests, r.URL.RawQuery)
+		}
+	})
+
+	headStatus = http.StatusOK
+	if err := ensureBucket(client, "bucket"); err != nil || len(requests) != 0 {
+		t.Errorf("Expected an existing bucket to be used as is: %v, %v", err, requests)
+	}
+
+	headStatus = http.StatusForbidden
+	createBucket = true
+	if err := ensureBucket(client, "bucket"); err == nil || !strings.Contains(err.Error(), "denied") || len(requests) != 0 {
+		t.Errorf("Expected a forbidden bucket to be reported, not created: %v, %v", err, requests)
+	}
+
+	headStatus = http.StatusNotFound
+	createBucket = false
+	if err := ensureBucket(client, "bucket"); err == nil || !strings.Contains(err.Error(), "--create-bucket") || len(requests) != 0 {
+		t.Errorf("Expected a missing bucket not to be created by default: %v, %v", err, requests)
+	}
+
+	// us-east-1 takes no location constraint
+	createBucket = true
+	if err := ensureBucket(client, "bucket"); err != nil || len(requests) != 1 || strings.Contains(createBody, "LocationConstraint") {
+		t.Errorf("Unexpected bucket creation in us-east-1: %v, %v, %s", err, requests, createBody)
+	}
+
+	requests = nil
+	client.Config.Region = aws.String("eu-west-1")
+	bucketEncryption, bucketVersioning, blockPublicAccess = "AES256", true, true
+	if err := ensureBucket(client, "bucket"); err != nil {
+		t.Fatalf("ensureBucket failed: %v", err)
+	}
+	if !strings.Contains(createBody, "<LocationConstraint>eu-west-1</LocationConstraint>") {
+		t.Errorf("Expected a location constraint, got %s", createBody)
+	}
+	want := []string{"create", "publicAccessBlock=", "encryption=", "versioning="}
+	if strings.Join(requests, " ") != strings.Join(want, " ") {
+		t.Errorf("Unexpected requests %v, want %v", requests, want)
+	}
+}
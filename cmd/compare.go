@@ -0,0 +1,48 @@
+package cmd
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// metaMD5 records the MD5 of the local file an object was uploaded from. It
+// is needed whenever the ETag is not a plain MD5 of the content, as with
+// SSE-KMS, SSE-C or multipart uploads.
+const metaMD5 = "s3sync-md5"
+
+// sameContent reports whether the object at key holds the same content as a
+// local file with the given checksum. A matching ETag settles it; otherwise
+// the checksum recorded in the object's metadata is consulted. With
+// --encrypt, a plaintext object never matches, so that it gets
+// encrypted on the next upload.
+func sameContent(s3Client *s3.S3, bucketName, key, etag, localChecksum string) (bool, error) {
+	if etag == localChecksum && !encryptContent {
+		return true, nil
+	}
+
+	input := &s3.HeadObjectInput{
+		Bucket:    aws.String(bucketName),
+		Key:       aws.String(remoteKey(key)),
+		VersionId: objectVersion(key),
+	}
+	head, err := headObject(s3Client, input)
+	if err != nil {
+		return false, err
+	}
+
+	if checksum, encrypted, err := encryptedChecksum(head.Metadata); encrypted {
+		if err != nil {
+			return false, err
+		}
+		return checksum == localChecksum, nil
+	}
+	if encryptContent && !isDirMarker(key) {
+		return false, nil
+	}
+
+	if etag == localChecksum {
+		return true, nil
+	}
+	stored, ok := metaValue(head.Metadata, metaMD5)
+	return ok && stored == localChecksum, nil
+}
@@ -0,0 +1,91 @@
+package cmd
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// newFakeS3Client returns a client that sends every request to handler.
+func newFakeS3Client(t *testing.T, handler http.HandlerFunc) *s3.S3 {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	sess, err := session.NewSession(&aws.Config{
+		Region:           aws.String("us-east-1"),
+		Endpoint:         aws.String(server.URL),
+		Credentials:      credentials.NewStaticCredentials("test", "test", ""),
+		S3ForcePathStyle: aws.Bool(true),
+		MaxRetries:       aws.Int(0),
+	})
+	if err != nil {
+		t.Fatalf("Failed to create AWS session: %v", err)
+	}
+	return s3.New(sess)
+}
+
+func TestSameContent(t *testing.T) {
+	heads := 0
+	client := newFakeS3Client(t, func(w http.ResponseWriter, r *http.Request) {
+		heads++
+		if r.Method != http.MethodHead {
+			t.Errorf("Unexpected %s request", r.Method)
+		}
+		if r.URL.Path == "/bucket/recorded" {
+			w.Header().Set("X-Amz-Meta-S3sync-Md5", "abc123")
+		}
+	})
+
+	same, err := sameContent(client, "bucket", "plain", "abc123", "abc123")
+	if err != nil || !same || heads != 0 {
+		t.Errorf("Expected a matching ETag to need no request: same=%v err=%v heads=%d", same, err, heads)
+	}
+
+	same, err = sameContent(client, "bucket", "recorded", "kms-etag", "abc123")
+	if err != nil || !same {
+		t.Errorf("Expected the recorded checksum to match: same=%v err=%v", same, err)
+	}
+
+	same, err = sameContent(client, "bucket", "unrecorded", "kms-etag", "abc123")
+	if err != nil || same {
+		t.Errorf("Expected an object without a recorded checksum to differ: same=%v err=%v", same, err)
+	}
+}
+
+func TestSameContentWithEncryption(t *testing.T) {
+	defer resetEncryptionFlags()
+	encryptContent, masterKey = true, make([]byte, 32)
+
+	meta := map[string]*string{}
+	if err := encryptStream(io.Discard, strings.NewReader("data"), meta, "abc123"); err != nil {
+		t.Fatalf("encryptStream failed: %v", err)
+	}
+
+	client := newFakeS3Client(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/bucket/encrypted":
+			for k, v := range meta {
+				w.Header().Set("X-Amz-Meta-"+k, *v)
+			}
+		case "/bucket/link":
+			w.Header().Set("X-Amz-Meta-S3sync-Symlink", "target")
+		}
+	})
+
+	if same, err := sameContent(client, "bucket", "encrypted", "cipher-etag", "abc123"); err != nil || !same {
+		t.Errorf("Expected the decrypted checksum to match: same=%v err=%v", same, err)
+	}
+	if same, err := sameContent(client, "bucket", "plain", "abc123", "abc123"); err != nil || same {
+		t.Errorf("Expected a plaintext object to be re-uploaded with --encrypt: same=%v err=%v", same, err)
+	}
+	if same, err := sameContent(client, "bucket", "link", "abc123", "abc123"); err != nil || same {
+		t.Errorf("Expected a plaintext symlink object to be replaced with --encrypt: same=%v err=%v", same, err)
+	}
+}
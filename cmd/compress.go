@@ -0,0 +1,127 @@
+package cmd
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression codecs accepted by --compress.
+const (
+	compressGzip = "gzip"
+	compressZstd = "zstd"
+)
+
+// metaCompression records the codec an object body was compressed with. It
+// is needed because Content-Encoding cannot be set on client-side encrypted
+// objects, whose body is ciphertext.
+const metaCompression = "s3sync-compression"
+
+var (
+	compressCodec    string
+	compressPatterns []string
+	decompressFiles  bool
+
+	compressGlobs []*globPattern
+)
+
+// loadCompressionConfig validates --compress and compiles the patterns that
+// select which keys are compressed. Without patterns every file is.
+func loadCompressionConfig() error {
+	compressGlobs = nil
+	switch compressCodec {
+	case "", compressGzip, compressZstd:
+	default:
+		return fmt.Errorf("invalid --compress value %q (want gzip or zstd)", compressCodec)
+	}
+	if compressCodec == "" && len(compressPatterns) > 0 {
+		return fmt.Errorf("--compress-pattern requires --compress")
+	}
+
+	for _, pattern := range compressPatterns {
+		glob, err := compileGlob(pattern)
+		if err != nil {
+			return fmt.Errorf("invalid --compress-pattern %q: %v", pattern, err)
+		}
+		compressGlobs = append(compressGlobs, glob)
+	}
+	return nil
+}
+
+// compressionFor returns the codec to upload key with, or "" to store it
+// as is.
+func compressionFor(key string) string {
+	if compressCodec == "" || len(compressGlobs) == 0 {
+		return compressCodec
+	}
+	for _, glob := range compressGlobs {
+		if glob.match(key) {
+			return compressCodec
+		}
+	}
+	return ""
+}
+
+func compressStream(dst io.Writer, src io.Reader, codec string) error {
+	var writer io.WriteCloser
+	switch codec {
+	case compressGzip:
+		writer = gzip.NewWriter(dst)
+	case compressZstd:
+		encoder, err := zstd.NewWriter(dst)
+		if err != nil {
+			return err
+		}
+		writer = encoder
+	default:
+		return fmt.Errorf("unsupported compression %q", codec)
+	}
+
+	if _, err := io.Copy(writer, src); err != nil {
+		writer.Close()
+		return err
+	}
+	return writer.Close()
+}
+
+// decompressingReader wraps body in a reader for codec.
+func decompressingReader(body io.Reader, codec string) (io.ReadCloser, error) {
+	switch codec {
+	case compressGzip:
+		return gzip.NewReader(body)
+	case compressZstd:
+		decoder, err := zstd.NewReader(body)
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	}
+	return nil, fmt.Errorf("unsupported compression %q", codec)
+}
+
+// spoolTemp writes a transformed body to a temporary file and rewinds it, so
+// that it can be sent as a seekable upload body. The caller closes the file
+// with removeTemp.
+func spoolTemp(write func(io.Writer) error) (*os.File, error) {
+	file, err := os.CreateTemp("", "s3sync-*")
+	if err != nil {
+		return nil, err
+	}
+	if err := write(file); err != nil {
+		removeTemp(file)
+		return nil, err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		removeTemp(file)
+		return nil, err
+	}
+	return file, nil
+}
+
+func removeTemp(file *os.File) {
+	file.Close()
+	os.Remove(file.Name())
+}
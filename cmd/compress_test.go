@@ -0,0 +1,131 @@
+package cmd
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCompressionFor(t *testing.T) {
+	defer func() {
+		compressCodec, compressPatterns = "", nil
+		loadCompressionConfig()
+	}()
+
+	if got := compressionFor("data.json"); got != "" {
+		t.Errorf("Expected no compression by default, got %q", got)
+	}
+
+	compressCodec = compressZstd
+	if err := loadCompressionConfig(); err != nil {
+		t.Fatalf("loadCompressionConfig failed: %v", err)
+	}
+	if got := compressionFor("img/photo.jpg"); got != compressZstd {
+		t.Errorf("Expected every key to be compressed without patterns, got %q", got)
+	}
+
+	compressCodec, compressPatterns = compressGzip, []string{"*.json", "logs/**"}
+	if err := loadCompressionConfig(); err != nil {
+		t.Fatalf("loadCompressionConfig failed: %v", err)
+	}
+	tests := map[string]string{
+		"data/set.json":    compressGzip,
+		"logs/2024/app.gz": compressGzip,
+		"img/photo.jpg":    "",
+	}
+	for key, want := range tests {
+		if got := compressionFor(key); got != want {
+			t.Errorf("compressionFor(%q) = %q, want %q", key, got, want)
+		}
+	}
+
+	compressCodec = "brotli"
+	if err := loadCompressionConfig(); err == nil {
+		t.Errorf("Expected an unknown codec to be rejected")
+	}
+	compressCodec = ""
+	if err := loadCompressionConfig(); err == nil {
+		t.Errorf("Expected --compress-pattern without --compress to be rejected")
+	}
+}
+
+func TestCompressRoundTrip(t *testing.T) {
+	plain := []byte(strings.Repeat(`{"id": 1, "name": "example"}`+"\n", 1000))
+	for _, codec := range []string{compressGzip, compressZstd} {
+		var compressed bytes.Buffer
+		if err := compressStream(&compressed, bytes.NewReader(plain), codec); err != nil {
+			t.Fatalf("compressStream(%s) failed: %v", codec, err)
+		}
+		if compressed.Len() >= len(plain)/5 {
+			t.Errorf("Expected %s to shrink repetitive JSON, got %d bytes", codec, compressed.Len())
+		}
+
+		reader, err := decompressingReader(&compressed, codec)
+		if err != nil {
+			t.Fatalf("decompressingReader(%s) failed: %v", codec, err)
+		}
+		out, err := io.ReadAll(reader)
+		reader.Close()
+		if err != nil || !bytes.Equal(out, plain) {
+			t.Errorf("Round trip through %s changed the content (err=%v)", codec, err)
+		}
+	}
+}
+
+func TestDownloadFileDecompresses(t *testing.T) {
+	defer resetEncryptionFlags()
+	plain := []byte(strings.Repeat("hello, world\n", 100))
+	var gzipped bytes.Buffer
+	if err := compressStream(&gzipped, bytes.NewReader(plain), compressGzip); err != nil {
+		t.Fatalf("compressStream failed: %v", err)
+	}
+
+	// Encrypted objects carry the codec in metadata only
+	masterKey, derivedKeys = make([]byte, 32), map[string][]byte{}
+	encMeta := map[string]*string{}
+	var sealed bytes.Buffer
+	if err := encryptStream(&sealed, bytes.NewReader(gzipped.Bytes()), encMeta, "x"); err != nil {
+		t.Fatalf("encryptStream failed: %v", err)
+	}
+
+	client := newFakeS3Client(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Accept-Encoding") != "identity" {
+			t.Errorf("Expected GetObject to disable transparent decompression")
+		}
+		w.Header().Set("X-Amz-Meta-S3sync-Compression", compressGzip)
+		switch r.URL.Path {
+		case "/bucket/plain.txt":
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Write(gzipped.Bytes())
+		case "/bucket/secret.txt":
+			for k, v := range encMeta {
+				w.Header().Set("X-Amz-Meta-"+k, *v)
+			}
+			w.Write(sealed.Bytes())
+		}
+	})
+
+	dir := t.TempDir()
+	for _, decompress := range []bool{true, false} {
+		decompressFiles = decompress
+		for _, key := range []string{"plain.txt", "secret.txt"} {
+			localPath := filepath.Join(dir, key)
+			if err := downloadFile(client, "bucket", key, localPath, nil); err != nil {
+				t.Fatalf("downloadFile(%s) failed: %v", key, err)
+			}
+			got, _ := os.ReadFile(localPath)
+			want := plain
+			if !decompress {
+				want = gzipped.Bytes()
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("Unexpected content for %s with decompress=%v", key, decompress)
+			}
+		}
+	}
+	decompressFiles = true
+}
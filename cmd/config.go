@@ -0,0 +1,186 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v3"
+)
+
+const envPrefix = "S3SYNC_"
+
+var (
+	configFile    string
+	configProfile string
+)
+
+// syncConfig is the layout of a config file. Each profile maps flag names to
+// the values they should default to.
+type syncConfig struct {
+	DefaultProfile string                            `yaml:"default_profile"`
+	Profiles       map[string]map[string]interface{} `yaml:"profiles"`
+}
+
+// configPaths lists the config files read when --config is not given, from
+// lowest to highest priority.
+func configPaths() []string {
+	var paths []string
+	if dir := os.Getenv("XDG_CONFIG_HOME"); dir != "" {
+		paths = append(paths, filepath.Join(dir, "s3sync", "config.yaml"))
+	} else if home, err := os.UserHomeDir(); err == nil {
+		paths = append(paths, filepath.Join(home, ".config", "s3sync", "config.yaml"))
+	}
+	return append(paths, ".s3sync.yaml")
+}
+
+// loadConfig reads and merges the config files. Files that do not exist are
+// skipped unless they were named explicitly.
+func loadConfig(explicit string) (*syncConfig, error) {
+	merged := &syncConfig{Profiles: map[string]map[string]interface{}{}}
+
+	paths := configPaths()
+	if explicit != "" {
+		paths = []string{explicit}
+	}
+
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			if os.IsNotExist(err) && explicit == "" {
+				continue
+			}
+			return nil, fmt.Errorf("failed to read config file: %v", err)
+		}
+
+		var cfg syncConfig
+		if err := yaml.Unmarshal(data, &cfg); err != nil {
+			return nil, fmt.Errorf("failed to parse config file %s: %v", path, err)
+		}
+		if cfg.DefaultProfile != "" {
+			merged.DefaultProfile = cfg.DefaultProfile
+		}
+		for name, settings := range cfg.Profiles {
+			if merged.Profiles[name] == nil {
+				merged.Profiles[name] = map[string]interface{}{}
+			}
+			for key, value := range settings {
+				merged.Profiles[name][key] = value
+			}
+		}
+	}
+
+	return merged, nil
+}
+
+// envName returns the environment variable that overrides the named flag.
+func envName(flag string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flag, "-", "_"))
+}
+
+// applyConfig fills in every flag that was not given on the command line,
+// first from S3SYNC_* environment variables and then from the selected config
+// profile, so that flags > env > config.
+func applyConfig(cmd *cobra.Command, args []string) error {
+	flags := cmd.Flags()
+
+	if !flags.Changed("config") {
+		configFile = os.Getenv(envName("config"))
+	}
+	if !flags.Changed("config-profile") {
+		if value, ok := os.LookupEnv(envName("config-profile")); ok {
+			configProfile = value
+		}
+	}
+
+	cfg, err := loadConfig(configFile)
+	if err != nil {
+		return err
+	}
+
+	profileName := configProfile
+	if profileName == "" {
+		profileName = cfg.DefaultProfile
+	}
+	if profileName == "" {
+		profileName = "default"
+	}
+	profile, ok := cfg.Profiles[profileName]
+	if !ok && (configProfile != "" || cfg.DefaultProfile != "") {
+		return fmt.Errorf("config profile %q not found", profileName)
+	}
+
+	known := knownFlags(cmd.Root())
+	for key := range profile {
+		if !known[key] || key == "config" || key == "config-profile" {
+			return fmt.Errorf("unknown setting %q in config profile %q", key, profileName)
+		}
+	}
+
+	var setErr error
+	flags.VisitAll(func(flag *pflag.Flag) {
+		if setErr != nil || flag.Changed || flag.Name == "config" || flag.Name == "config-profile" {
+			return
+		}
+		if value, ok := os.LookupEnv(envName(flag.Name)); ok {
+			if err := flags.Set(flag.Name, value); err != nil {
+				setErr = fmt.Errorf("invalid value for %s: %v", envName(flag.Name), err)
+			}
+			return
+		}
+		if value, ok := profile[flag.Name]; ok {
+			if err := setFromConfig(flags, flag.Name, value); err != nil {
+				setErr = fmt.Errorf("invalid value for %q in config profile %q: %v", flag.Name, profileName, err)
+			}
+		}
+	})
+	return setErr
+}
+
+// setFromConfig sets a flag from a decoded YAML value. Lists set the flag
+// once per element so that repeatable flags accumulate.
+func setFromConfig(flags *pflag.FlagSet, name string, value interface{}) error {
+	if list, ok := value.([]interface{}); ok {
+		for _, item := range list {
+			if err := flags.Set(name, fmt.Sprint(item)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return flags.Set(name, fmt.Sprint(value))
+}
+
+// knownFlags collects the flag names of cmd and all of its subcommands.
+func knownFlags(cmd *cobra.Command) map[string]bool {
+	known := map[string]bool{}
+	collect := func(flag *pflag.Flag) { known[flag.Name] = true }
+	cmd.PersistentFlags().VisitAll(collect)
+	cmd.Flags().VisitAll(collect)
+	for _, sub := range cmd.Commands() {
+		for name := range knownFlags(sub) {
+			known[name] = true
+		}
+	}
+	return known
+}
+
+// requireFlags returns a PreRunE that fails unless each named flag was set on
+// the command line, in the environment or in the config file.
+func requireFlags(names ...string) func(cmd *cobra.Command, args []string) error {
+	return func(cmd *cobra.Command, args []string) error {
+		var missing []string
+		for _, name := range names {
+			if !cmd.Flags().Changed(name) {
+				missing = append(missing, fmt.Sprintf("%q", name))
+			}
+		}
+		if len(missing) > 0 {
+			return fmt.Errorf("required flag(s) %s not set", strings.Join(missing, ", "))
+		}
+		return nil
+	}
+}
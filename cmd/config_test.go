@@ -0,0 +1,131 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/cobra"
+)
+
+// newConfigTestCommand builds a command tree with the same config flags as
+// rootCmd but its own settings, so tests do not touch the real commands.
+func newConfigTestCommand(bucket, region *string, del *bool) *cobra.Command {
+	root := &cobra.Command{Use: "test", PersistentPreRunE: applyConfig}
+	root.PersistentFlags().StringVar(&configFile, "config", "", "")
+	root.PersistentFlags().StringVar(&configProfile, "config-profile", "", "")
+	root.PersistentFlags().StringVarP(bucket, "bucket", "b", "", "")
+	root.PersistentFlags().StringVarP(region, "region", "r", "us-east-1", "")
+	root.PersistentFlags().BoolVarP(del, "delete", "d", false, "")
+
+	sub := &cobra.Command{
+		Use:     "sub",
+		PreRunE: requireFlags("bucket"),
+		RunE:    func(cmd *cobra.Command, args []string) error { return nil },
+	}
+	root.AddCommand(sub)
+	return root
+}
+
+func writeTestConfig(t *testing.T, dir, content string) string {
+	path := filepath.Join(dir, "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+	return path
+}
+
+func TestApplyConfigPrecedence(t *testing.T) {
+	path := writeTestConfig(t, t.TempDir(), `
+default_profile: staging
+profiles:
+  staging:
+    bucket: staging-bucket
+    region: eu-west-1
+    delete: true
+  prod:
+    bucket: prod-bucket
+`)
+
+	var bucket, region string
+	var del bool
+	root := newConfigTestCommand(&bucket, &region, &del)
+
+	t.Setenv("S3SYNC_REGION", "ap-south-1")
+	root.SetArgs([]string{"sub", "--config", path, "--bucket", "flag-bucket"})
+	if err := root.Execute(); err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+
+	if bucket != "flag-bucket" {
+		t.Errorf("Expected flag to win for bucket, got %q", bucket)
+	}
+	if region != "ap-south-1" {
+		t.Errorf("Expected environment to win for region, got %q", region)
+	}
+	if !del {
+		t.Errorf("Expected delete to be enabled from the config profile")
+	}
+}
+
+func TestApplyConfigNamedProfile(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "s3sync"), 0755); err != nil {
+		t.Fatalf("Failed to create config directory: %v", err)
+	}
+	writeTestConfig(t, filepath.Join(dir, "s3sync"), `
+profiles:
+  default:
+    bucket: default-bucket
+  prod:
+    bucket: prod-bucket
+`)
+	t.Setenv("XDG_CONFIG_HOME", dir)
+
+	var bucket, region string
+	var del bool
+	root := newConfigTestCommand(&bucket, &region, &del)
+
+	t.Setenv("S3SYNC_CONFIG_PROFILE", "prod")
+	root.SetArgs([]string{"sub"})
+	if err := root.Execute(); err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+	if bucket != "prod-bucket" {
+		t.Errorf("Expected bucket from prod profile, got %q", bucket)
+	}
+}
+
+func TestApplyConfigRejectsUnknownSetting(t *testing.T) {
+	path := writeTestConfig(t, t.TempDir(), `
+profiles:
+  default:
+    bucket: my-bucket
+    buckt: typo
+`)
+
+	var bucket, region string
+	var del bool
+	root := newConfigTestCommand(&bucket, &region, &del)
+	root.SilenceErrors = true
+	root.SilenceUsage = true
+
+	root.SetArgs([]string{"sub", "--config", path})
+	if err := root.Execute(); err == nil {
+		t.Fatal("Expected an error for an unknown config setting")
+	}
+}
+
+func TestRequireFlagsMissing(t *testing.T) {
+	var bucket, region string
+	var del bool
+	root := newConfigTestCommand(&bucket, &region, &del)
+	root.SilenceErrors = true
+	root.SilenceUsage = true
+
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	root.SetArgs([]string{"sub"})
+	if err := root.Execute(); err == nil {
+		t.Fatal("Expected an error when the bucket is not set anywhere")
+	}
+}
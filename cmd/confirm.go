@@ -0,0 +1,69 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// confirmPageSize is the number of items listed at a time before asking.
+const confirmPageSize = 20
+
+var assumeYes bool
+
+// confirmInput is where answers are read from, and stdinIsTerminal decides
+// whether anyone is there to answer. Tests replace both.
+var (
+	confirmInput    io.Reader = os.Stdin
+	stdinIsTerminal           = func() bool {
+		info, err := os.Stdin.Stat()
+		return err == nil && info.Mode()&os.ModeCharDevice != 0
+	}
+)
+
+// confirmDeletes lists what is about to be removed and asks whether to go
+// ahead. With --yes it does not ask, and without a terminal to ask on it
+// refuses, so that unattended runs only delete when told to up front.
+// action describes the removal, e.g. "deleted from s3://bucket".
+func confirmDeletes(items []string, action string) error {
+	if len(items) == 0 || assumeYes {
+		return nil
+	}
+	if !stdinIsTerminal() {
+		return fmt.Errorf("refusing to remove %d item(s) without confirmation; pass --yes to run non-interactively", len(items))
+	}
+
+	fmt.Printf("%d item(s) will be %s:\n", len(items), action)
+	reader := bufio.NewReader(confirmInput)
+	shown := 0
+	for {
+		end := min(shown+confirmPageSize, len(items))
+		for _, item := range items[shown:end] {
+			fmt.Printf("  %s\n", item)
+		}
+		shown = end
+
+		prompt := "Continue? [y/N] "
+		if shown < len(items) {
+			fmt.Printf("  ... and %d more\n", len(items)-shown)
+			prompt = "Continue? [y/N/m(ore)] "
+		}
+		fmt.Print(prompt)
+
+		answer, err := reader.ReadString('\n')
+		switch strings.ToLower(strings.TrimSpace(answer)) {
+		case "y", "yes":
+			return nil
+		case "m", "more":
+			if err == nil {
+				continue
+			}
+		}
+		if err != nil && err != io.EOF {
+			return err
+		}
+		return fmt.Errorf("aborted; nothing was changed")
+	}
+}
@@ -0,0 +1,51 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestConfirmDeletes(t *testing.T) {
+	input, terminal := confirmInput, stdinIsTerminal
+	defer func() { confirmInput, stdinIsTerminal, assumeYes = input, terminal, false }()
+
+	interactive := false
+	stdinIsTerminal = func() bool { return interactive }
+
+	items := make([]string, 45)
+	for i := range items {
+		items[i] = fmt.Sprintf("file%02d.txt", i)
+	}
+
+	if err := confirmDeletes(nil, "deleted"); err != nil {
+		t.Errorf("Expected nothing to confirm for no items, got %v", err)
+	}
+	if err := confirmDeletes(items, "deleted"); err == nil || !strings.Contains(err.Error(), "--yes") {
+		t.Errorf("Expected a non-interactive run to be refused, got %v", err)
+	}
+	assumeYes = true
+	if err := confirmDeletes(items, "deleted"); err != nil {
+		t.Errorf("Expected --yes to skip the prompt, got %v", err)
+	}
+	assumeYes = false
+
+	interactive = true
+	answers := map[string]bool{
+		"y\n":           true,
+		"YES\n":         true,
+		"m\nm\ny\n":     true,
+		"m\nm\nm\ny\n":  true,
+		"\n":            false,
+		"n\n":           false,
+		"m\n":           false,
+		"":              false,
+		"whatever\ny\n": false,
+	}
+	for input, confirmed := range answers {
+		confirmInput = strings.NewReader(input)
+		if err := confirmDeletes(items, "deleted"); (err == nil) != confirmed {
+			t.Errorf("Answer %q: got %v", input, err)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package cmd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// maxDeleteBatch is the most keys a single DeleteObjects request accepts.
+const maxDeleteBatch = 1000
+
+var maxDelete string
+
+// deleteLimit is a parsed --max-delete: either a number of keys or, with
+// percent, a percentage of the keys present at the destination.
+type deleteLimit struct {
+	max     float64
+	percent bool
+}
+
+// loadDeleteLimit parses --max-delete. It returns nil when there is no limit.
+func loadDeleteLimit() (*deleteLimit, error) {
+	if maxDelete == "" {
+		return nil, nil
+	}
+	value, percent := strings.CutSuffix(maxDelete, "%")
+	limit, err := strconv.ParseFloat(value, 64)
+	if err != nil || limit < 0 || (percent && limit > 100) || (!percent && limit != float64(int(limit))) {
+		return nil, fmt.Errorf("invalid --max-delete %q (want a count or a percentage such as 10%%)", maxDelete)
+	}
+	return &deleteLimit{max: limit, percent: percent}, nil
+}
+
+// check fails if deleting planned of the existing keys would exceed the
+// limit. It runs before anything is changed, so that e.g. syncing an empty
+// directory by mistake cannot wipe the destination.
+func (l *deleteLimit) check(planned, existing int) error {
+	if l == nil || planned == 0 {
+		return nil
+	}
+	exceeded := float64(planned) > l.max
+	if l.percent {
+		exceeded = float64(planned)*100 > l.max*float64(existing)
+	}
+	if exceeded {
+		return fmt.Errorf("refusing to delete %d of %d, more than --max-delete %s; nothing was changed", planned, existing, maxDelete)
+	}
+	return nil
+}
+
+// deleteObjects deletes keys, as stored, with DeleteObjects in batches. Keys
+// that S3 refused to delete are returned with the reason; err is only set if
+// a whole batch failed.
+func deleteObjects(s3Client *s3.S3, bucketName string, keys []string) (map[string]string, error) {
+	failed := make(map[string]string)
+	for start := 0; start < len(keys); start += maxDeleteBatch {
+		end := min(start+maxDeleteBatch, len(keys))
+
+		objects := make([]*s3.ObjectIdentifier, 0, end-start)
+		for _, key := range keys[start:end] {
+			objects = append(objects, &s3.ObjectIdentifier{Key: aws.String(key)})
+		}
+
+		// Quiet mode only reports the keys that could not be deleted
+		output, err := s3Client.DeleteObjects(&s3.DeleteObjectsInput{
+			Bucket: aws.String(bucketName),
+			Delete: &s3.Delete{
+				Objects: objects,
+				Quiet:   aws.Bool(true),
+			},
+		})
+		if err != nil {
+			return failed, err
+		}
+		for _, e := range output.Errors {
+			failed[aws.StringValue(e.Key)] = fmt.Sprintf("%s: %s", aws.StringValue(e.Code), aws.StringValue(e.Message))
+		}
+	}
+	return failed, nil
+}
@@ -0,0 +1,155 @@
+package cmd
+
+import (
+	"encoding/xml"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDeleteLimit(t *testing.T) {
+	defer func() { maxDelete = "" }()
+
+	tests := []struct {
+		value             string
+		planned, existing int
+		allowed           bool
+	}{
+		{"", 100, 100, true},
+		{"10", 10, 100, true},
+		{"10", 11, 100, false},
+		{"0", 1, 100, false},
+		{"10%", 10, 100, true},
+		{"10%", 11, 100, false},
+		{"0%", 0, 100, true},
+		{"50%", 1, 1, false},
+	}
+	for _, test := range tests {
+		maxDelete = test.value
+		limit, err := loadDeleteLimit()
+		if err != nil {
+			t.Fatalf("loadDeleteLimit(%q) failed: %v", test.value, err)
+		}
+		if err := limit.check(test.planned, test.existing); (err == nil) != test.allowed {
+			t.Errorf("--max-delete %s with %d of %d: got %v", test.value, test.planned, test.existing, err)
+		}
+	}
+
+	for _, invalid := range []string{"ten", "-1", "1.5", "101%", "%"} {
+		maxDelete = invalid
+		if _, err := loadDeleteLimit(); err == nil {
+			t.Errorf("Expected --max-delete %q to be rejected", invalid)
+		}
+	}
+}
+
+func TestDeleteObjectsBatches(t *testing.T) {
+	var batches []int
+	client := newFakeS3Client(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || !r.URL.Query().Has("delete") {
+			t.Errorf("Unexpected request %s %s", r.Method, r.URL)
+		}
+		var request struct {
+			Objects []struct{ Key string } `xml:"Object"`
+			Quiet   bool
+		}
+		if err := xml.NewDecoder(r.Body).Decode(&request); err != nil || !request.Quiet {
+			t.Errorf("Unexpected delete request: %+v, %v", request, err)
+		}
+		batches = append(batches, len(request.Objects))
+
+		var body strings.Builder
+		body.WriteString(`<DeleteResult>`)
+		for _, object := range request.Objects {
+			if strings.HasPrefix(object.Key, "locked/") {
+				body.WriteString(`<Error><Key>` + object.Key + `</Key><Code>AccessDenied</Code><Message>Access Denied</Message></Error>`)
+			}
+		}
+		body.WriteString(`</DeleteResult>`)
+		w.Write([]byte(body.String()))
+	})
+
+	keys := make([]string, 0, 2500)
+	for i := 0; i < 2499; i++ {
+		keys = append(keys, "file"+strings.Repeat("x", i%7))
+	}
+	keys = append(keys, "locked/a.txt")
+
+	failed, err := deleteObjects(client, "bucket", keys)
+	if err != nil {
+		t.Fatalf("deleteObjects failed: %v", err)
+	}
+	if len(batches) != 3 || batches[0] != 1000 || batches[1] != 1000 || batches[2] != 500 {
+		t.Errorf("Unexpected batch sizes %v", batches)
+	}
+	if len(failed) != 1 || failed["locked/a.txt"] != "AccessDenied: Access Denied" {
+		t.Errorf("Unexpected failures %v", failed)
+	}
+}
+
+func TestUploadMaxDelete(t *testing.T) {
+	defer func() { deleteExtra, maxDelete, assumeYes = false, "", false }()
+
+	store := &fakeObjectStore{objects: map[string]string{"a.txt": "a", "b.txt": "b", "c.txt": "c"}}
+	useFakeEndpoint(t, store)
+
+	// An empty input directory would delete everything
+	deleteExtra, maxDelete, assumeYes = true, "50%", true
+	if err := uploadToS3(t.TempDir(), "bucket"); err == nil || !strings.Contains(err.Error(), "--max-delete") {
+		t.Fatalf("Expected the deletes to be refused, got %v", err)
+	}
+	if got := store.keys(); len(got) != 3 {
+		t.Fatalf("Expected nothing to be deleted, got %v", got)
+	}
+
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "a.txt"), []byte("a"), 0644)
+	os.WriteFile(filepath.Join(dir, "b.txt"), []byte("b"), 0644)
+	if err := uploadToS3(dir, "bucket"); err != nil {
+		t.Fatalf("uploadToS3 failed: %v", err)
+	}
+	if _, ok := store.objects["c.txt"]; ok || len(store.objects) != 2 {
+		t.Errorf("Expected c.txt to be deleted and no run recorded without versioning, got %v", store.keys())
+	}
+
+	// Runs are only recorded where they can be rolled back
+	store.versioned = true
+	os.WriteFile(filepath.Join(dir, "c.txt"), []byte("c"), 0644)
+	if err := uploadToS3(dir, "bucket"); err != nil {
+		t.Fatalf("uploadToS3 failed: %v", err)
+	}
+	if got := store.keys(); len(got) != 4 || !strings.HasPrefix(got[0], runRecordPrefix) {
+		t.Errorf("Expected the run to be recorded, got %v", got)
+	}
+}
+
+func TestUploadRemovesStaleSidecars(t *testing.T) {
+	defer func() { deleteExtra, assumeYes = false, false }()
+
+	store := &fakeObjectStore{objects: map[string]string{
+		"changed.txt":                "old",
+		"same.txt":                   "same",
+		"gone.txt":                   "gone",
+		".s3sync/xattrs/changed.txt": "attrs",
+		".s3sync/xattrs/same.txt":    "attrs",
+		".s3sync/xattrs/gone.txt":    "attrs",
+	}}
+	useFakeEndpoint(t, store)
+
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "changed.txt"), []byte("new"), 0644)
+	os.WriteFile(filepath.Join(dir, "same.txt"), []byte("same"), 0644)
+
+	// Neither --xattrs nor a sidecar on the new objects is needed
+	deleteExtra, assumeYes = true, true
+	if err := uploadToS3(dir, "bucket"); err != nil {
+		t.Fatalf("uploadToS3 failed: %v", err)
+	}
+	want := []string{".s3sync/xattrs/same.txt", "changed.txt", "same.txt"}
+	if got := store.keys(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected keys %v, want %v", got, want)
+	}
+}
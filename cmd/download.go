@@ -1,22 +1,25 @@
 package cmd
 
 import (
+    "errors"
     "fmt"
     "io"
     "os"
     "path/filepath"
+    "sort"
     "strings"
+    "time"
 
     "github.com/aws/aws-sdk-go/aws"
-    "github.com/aws/aws-sdk-go/aws/credentials"
-    "github.com/aws/aws-sdk-go/aws/session"
+    "github.com/aws/aws-sdk-go/aws/request"
     "github.com/aws/aws-sdk-go/service/s3"
     "github.com/spf13/cobra"
 )
 
 var syncCmd = &cobra.Command{
-    Use:   "download",
-    Short: "Sync directory with S3 bucket",
+    Use:     "download",
+    Short:   "Sync directory with S3 bucket",
+    PreRunE: requireFlags("output", "bucket"),
     RunE: func(cmd *cobra.Command, args []string) error {
         return downloadToLocal(bucketName, outputDir)
     },
@@ -25,30 +28,56 @@ var syncCmd = &cobra.Command{
 func init() {
     rootCmd.AddCommand(syncCmd)
     syncCmd.Flags().StringVarP(&outputDir, "output", "o", "", "Local directory path")
-    syncCmd.Flags().StringVarP(&bucketName, "bucket", "b", "", "S3 bucket name")
-    syncCmd.Flags().StringVarP(&endpointURL, "endpoint", "e", "", "AWS Endpoint URL (for testing with LocalStack)")
-    syncCmd.Flags().StringVarP(&region, "region", "r", "us-east-1", "AWS Region")
-    syncCmd.Flags().BoolVarP(&deleteExtra, "delete", "d", false, "Delete files that are not present in the source")
-    syncCmd.MarkFlagRequired("input")
-    syncCmd.MarkFlagRequired("bucket")
+    syncCmd.Flags().StringVar(&keyConflictPolicy, "key-conflicts", conflictSkip, "How to handle keys that cannot be stored locally: skip, rename or fail")
+    syncCmd.Flags().BoolVar(&decompressFiles, "decompress", true, "Decompress objects uploaded with --compress back to the original bytes")
+    syncCmd.Flags().StringVar(&asOfTimestamp, "as-of", "", "Download the bucket as it was at this time (RFC 3339, date, or duration ago); needs a versioned bucket")
+    syncCmd.Flags().StringArrayVar(&filterTags, "filter-tag", nil, "Only download objects with this tag, as key=value or key (repeatable, all must match)")
+    syncCmd.Flags().BoolVar(&restoreArchived, "restore", false, "Request restores of GLACIER and DEEP_ARCHIVE objects and download them on a later run")
+    syncCmd.Flags().StringVar(&restoreTier, "restore-tier", "Standard", "Retrieval tier for --restore: Standard, Bulk or Expedited")
+    syncCmd.Flags().Int64Var(&restoreDays, "restore-days", 1, "Number of days restored copies stay available")
+    syncCmd.Flags().BoolVar(&noRestoreOwner, "no-owner", false, "Do not restore file ownership (uid/gid) recorded at upload")
+    syncCmd.Flags().StringVar(&backupDir, "backup-dir", "", "Move local files that are replaced or deleted into <dir>/<run-id>/ instead of losing them")
 }
 
 // Function to sync from S3 to local directory
 func downloadToLocal(bucketName, localDir string) error {
-    config := &aws.Config{
-        Region: aws.String(region),
+    if err := loadSSEConfig(); err != nil {
+        return err
+    }
+
+    if err := loadEncryptionConfig(); err != nil {
+        return err
+    }
+
+    if err := validateRestoreOptions(); err != nil {
+        return err
+    }
+
+    if err := loadTagConfig(); err != nil {
+        return err
+    }
+
+    limit, err := loadDeleteLimit()
+    if err != nil {
+        return err
+    }
+
+    backups, err := newLocalBackup(localDir, time.Now())
+    if err != nil {
+        return err
     }
 
-    if endpointURL != "" {
-        config.Endpoint = aws.String(endpointURL)
-        config.S3ForcePathStyle = aws.Bool(true)
-        // Set static credentials for LocalStack
-        config.Credentials = credentials.NewStaticCredentials("test", "test", "")
+    var asOf time.Time
+    if asOfTimestamp != "" {
+        var err error
+        if asOf, err = parseAsOf(asOfTimestamp, time.Now()); err != nil {
+            return err
+        }
     }
 
-    sess, err := session.NewSession(config)
+    sess, err := newSession()
     if err != nil {
-        return fmt.Errorf("failed to create AWS session: %v", err)
+        return err
     }
 
     s3Client := s3.New(sess)
@@ -61,99 +90,263 @@ func downloadToLocal(bucketName, localDir string) error {
         return fmt.Errorf("failed to access bucket: %v", err)
     }
 
-    // Map to store local files and their checksums
-    localFiles := make(map[string]string)
-
     // Walk through the local directory and compute checksums
-    err = filepath.Walk(localDir, func(path string, info os.FileInfo, err error) error {
-        if err != nil {
-            return err
+    localFiles, err := scanLocalFiles(localDir)
+    if err != nil {
+        return err
+    }
+
+    // Files that have no object key cannot be synced, but are no reason to
+    // fail a download; they are reported and left alone
+    for relativePath := range localFiles {
+        if _, err := objectKey(relativePath); err != nil {
+            fmt.Printf("Skipped local file: %v\n", err)
+            delete(localFiles, relativePath)
         }
+    }
 
-        if !info.IsDir() {
-            relativePath, err := filepath.Rel(localDir, path)
-            if err != nil {
-                return err
-            }
+    // Index local files by the object key they correspond to
+    localByKey, err := indexLocalFiles(localFiles)
+    if err != nil {
+        return err
+    }
 
-            checksum, err := computeMD5Checksum(path)
-            if err != nil {
-                return err
-            }
+    // Map to store S3 objects and their ETags, and their storage classes
+    s3Objects := make(map[string]string)
+    s3Classes := make(map[string]string)
 
-            localFiles[relativePath] = checksum
+    if asOfTimestamp != "" {
+        // Reconstruct the bucket from the versions current at that time
+        s3Objects, s3Classes, pinnedVersions, err = listVersionsAsOf(s3Client, bucketName, "", asOf)
+        if err != nil {
+            return err
+        }
+        defer func() { pinnedVersions = nil }()
+    } else {
+        // List objects in the S3 bucket
+        err = s3Client.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+            Bucket: aws.String(bucketName),
+        }, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+            for _, obj := range page.Contents {
+                key := *obj.Key
+                if isInternalKey(key) {
+                    continue
+                }
+                key, ok := listedKey(key)
+                if !ok {
+                    continue
+                }
+                etag := strings.Trim(*obj.ETag, "\"") // Remove quotes from ETag
+                s3Objects[key] = etag
+                s3Classes[key] = listedStorageClass(obj)
+            }
+            return !lastPage
+        })
+        if err != nil {
+            return fmt.Errorf("failed to list objects in bucket: %v", err)
         }
+    }
 
-        return nil
-    })
+    // Objects without the requested tags are treated as absent
+    if err := filterByTags(s3Client, bucketName, s3Objects); err != nil {
+        return err
+    }
+
+    // Decide where each key goes locally before downloading anything
+    keys := make([]string, 0, len(s3Objects))
+    for s3Key := range s3Objects {
+        keys = append(keys, s3Key)
+    }
+    plan, issues, err := planLocalPaths(keys, localByKey)
     if err != nil {
         return err
     }
+    localByPath := make(map[string]localEntry, len(localByKey))
+    for _, local := range localByKey {
+        localByPath[filepath.ToSlash(local.Path)] = local
+    }
 
-    // Map to store S3 objects and their ETags
-    s3Objects := make(map[string]string)
+    // Map of local paths that correspond to S3 objects
+    wanted := make(map[string]string, len(plan))
+    for s3Key, localKey := range plan {
+        wanted[localKey] = s3Objects[s3Key]
+    }
 
-    // List objects in the S3 bucket
-    err = s3Client.ListObjectsV2Pages(&s3.ListObjectsV2Input{
-        Bucket: aws.String(bucketName),
-    }, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
-        for _, obj := range page.Contents {
-            key := *obj.Key
-            etag := strings.Trim(*obj.ETag, "\"") // Remove quotes from ETag
-            s3Objects[key] = etag
+    // Decide what --delete removes before changing anything
+    var toDelete []string
+    if deleteExtra {
+        inS3 := make(map[string]bool, len(s3Objects))
+        for s3Key := range s3Objects {
+            inS3[normalizeKey(s3Key)] = true
         }
-        return !lastPage
-    })
+        for s3Key, local := range localByKey {
+            if _, exists := wanted[filepath.ToSlash(local.Path)]; !exists && !inS3[s3Key] {
+                toDelete = append(toDelete, s3Key)
+            }
+        }
+        sort.Strings(toDelete)
+        if err := limit.check(len(toDelete), len(localByKey)); err != nil {
+            return err
+        }
+
+        paths := make([]string, 0, len(toDelete))
+        for _, s3Key := range toDelete {
+            paths = append(paths, filepath.ToSlash(localByKey[s3Key].Path))
+        }
+        action := "deleted from " + localDir
+        if backups != nil {
+            action = "moved from " + localDir + " to " + backups.dir
+        }
+        if err := confirmDeletes(paths, action); err != nil {
+            return err
+        }
+    }
+
+    // Restores requested by earlier runs; keys that are gone are forgotten
+    restores, err := loadRestoreState(localDir)
     if err != nil {
-        return fmt.Errorf("failed to list objects in bucket: %v", err)
+        return err
+    }
+    for s3Key := range restores.Pending {
+        if isArchived(s3Classes[s3Key]) {
+            continue
+        }
+        restores.remove(s3Key)
     }
 
+    // Keys that would be written outside localDir are reported and skipped
+    var rejected []string
+
     // Download new or updated files
-    for s3Key, s3Checksum := range s3Objects {
-        localChecksum, exists := localFiles[s3Key]
-        if !exists || localChecksum != s3Checksum {
+    for s3Key, localKey := range plan {
+        s3Checksum := s3Objects[s3Key]
+        localFilePath, err := safeLocalPath(localDir, localKey)
+        if err != nil {
+            fmt.Printf("Error: %v\n", err)
+            rejected = append(rejected, s3Key)
+            continue
+        }
+
+        // The planned path is where the key was stored before, even if it
+        // was renamed to fit the local filesystem
+        local, exists := localByPath[localKey]
+        unchanged := false
+        if isDirMarker(s3Key) {
+            unchanged = dirExists(localFilePath)
+        } else if exists {
+            unchanged, err = sameContent(s3Client, bucketName, s3Key, s3Checksum, local.Checksum)
+            if err != nil {
+                return fmt.Errorf("failed to check object %s: %v", s3Key, err)
+            }
+        }
+        if !unchanged {
+            // Archived objects are only downloaded once they are restored
+            if isArchived(s3Classes[s3Key]) {
+                ready, err := prepareArchived(s3Client, bucketName, s3Key, s3Classes[s3Key], restores)
+                if err != nil {
+                    return err
+                }
+                if !ready {
+                    continue
+                }
+            }
+
             // File is new or has changed, download it
-            err := downloadFile(s3Client, bucketName, localDir, s3Key)
+            err := downloadFile(s3Client, bucketName, s3Key, localFilePath, backups)
+            if isArchivedError(err) {
+                fmt.Printf("Skipped (archived, must be restored first): %s\n", s3Key)
+                continue
+            }
+            if err == errSymlinkSkipped {
+                fmt.Printf("Skipped (symlink, use --symlinks=preserve): %s\n", s3Key)
+                continue
+            }
             if err != nil {
                 return err
             }
-            fmt.Printf("Downloaded s3://%s/%s to %s\n", bucketName, s3Key, s3Key)
+            fmt.Printf("Downloaded s3://%s/%s to %s\n", bucketName, s3Key, localKey)
+            restores.remove(s3Key)
         } else {
             fmt.Printf("Skipped (unchanged): %s\n", s3Key)
+            restores.remove(s3Key)
         }
     }
 
     // Optionally delete local files that are not in S3
-    if deleteExtra {
-        for localKey := range localFiles {
-            if _, exists := s3Objects[localKey]; !exists {
-                // Delete the local file
-                localFilePath := filepath.Join(localDir, localKey)
-                err := os.Remove(localFilePath)
-                if err != nil {
-                    return fmt.Errorf("failed to delete local file %s: %v", localFilePath, err)
-                }
-                fmt.Printf("Deleted local file: %s\n", localKey)
+    for _, s3Key := range toDelete {
+        local := localByKey[s3Key]
+        localKey := filepath.ToSlash(local.Path)
+        // Delete the local file
+        localFilePath := filepath.Join(localDir, local.Path)
+        saved := ""
+        if backups != nil {
+            saved, err = backups.save(local.Path)
+            if err != nil {
+                return fmt.Errorf("failed to back up local file %s: %v", localFilePath, err)
+            }
+        }
+        if saved != "" {
+            fmt.Printf("Moved deleted local file %s to %s\n", localKey, saved)
+        } else {
+            // Directories of marker keys are not backed up
+            err := os.Remove(localFilePath)
+            if err != nil {
+                return fmt.Errorf("failed to delete local file %s: %v", localFilePath, err)
             }
+            fmt.Printf("Deleted local file: %s\n", localKey)
+        }
+        pruneEmptyDirs(localDir, localKey, wanted)
+    }
+
+    if err := restores.save(); err != nil {
+        return fmt.Errorf("failed to save restore state: %v", err)
+    }
+    if len(restores.Pending) > 0 {
+        fmt.Printf("%d archived object(s) are waiting for a restore; run the download again later\n", len(restores.Pending))
+    }
+
+    if len(issues) > 0 {
+        fmt.Printf("%d key(s) could not be stored under their own name:\n", len(issues))
+        for _, issue := range issues {
+            fmt.Printf("  %s\n", issue)
         }
     }
 
+    if len(rejected) > 0 {
+        return fmt.Errorf("%d unsafe key(s) were not downloaded: %s", len(rejected), strings.Join(rejected, ", "))
+    }
+
     return nil
 }
 
-// Function to download a file from S3
-func downloadFile(s3Client *s3.S3, bucketName, localDir, s3Key string) error {
-    output, err := s3Client.GetObject(&s3.GetObjectInput{
-        Bucket: aws.String(bucketName),
-        Key:    aws.String(s3Key),
-    })
+// errSymlinkSkipped is returned by downloadFile for a symlink object when
+// --symlinks=preserve is not set; nothing local has been changed then.
+var errSymlinkSkipped = errors.New("symlink object skipped")
+
+// Function to download a file from S3. With backups, the local file it
+// replaces is moved there first, once the object is known to be written.
+func downloadFile(s3Client *s3.S3, bucketName, s3Key, localFilePath string, backups *localBackup) error {
+    // Directory markers only need the directory itself
+    if isDirMarker(s3Key) {
+        return os.MkdirAll(localFilePath, os.ModePerm)
+    }
+
+    input := &s3.GetObjectInput{
+        Bucket:    aws.String(bucketName),
+        Key:       aws.String(remoteKey(s3Key)),
+        VersionId: objectVersion(s3Key),
+    }
+    applySSEToGet(input)
+
+    // Ask for the stored bytes; otherwise the HTTP client would silently
+    // decompress gzip-encoded objects itself
+    output, err := s3Client.GetObjectWithContext(aws.BackgroundContext(), input,
+        request.WithSetRequestHeaders(map[string]string{"Accept-Encoding": "identity"}))
     if err != nil {
         return err
     }
     defer output.Body.Close()
 
-    // Create the local file path
-    localFilePath := filepath.Join(localDir, s3Key)
     localDirPath := filepath.Dir(localFilePath)
 
     // Ensure the directory exists
@@ -162,14 +355,77 @@ func downloadFile(s3Client *s3.S3, bucketName, localDir, s3Key string) error {
         return err
     }
 
+    // Recreate symlinks uploaded with --symlinks=preserve
+    target, isSymlink, err := symlinkTarget(output.Metadata)
+    if err != nil {
+        return err
+    }
+    if isSymlink && symlinkPolicy != symlinksPreserve {
+        return errSymlinkSkipped
+    }
+
+    // Keep the version being replaced
+    if err := backups.keep(localFilePath); err != nil {
+        return err
+    }
+
+    if isSymlink {
+        return createSymlink(target, localFilePath)
+    }
+
+    // Replace an existing symlink rather than writing through it
+    if info, err := os.Lstat(localFilePath); err == nil && info.Mode()&os.ModeSymlink != 0 {
+        if err := os.Remove(localFilePath); err != nil {
+            return err
+        }
+    }
+
     // Create the local file
     localFile, err := os.Create(localFilePath)
     if err != nil {
         return err
     }
-    defer localFile.Close()
 
-    // Copy the content
-    _, err = io.Copy(localFile, output.Body)
+    // Copy the content, decrypting and decompressing it as needed
+    err = copyObjectBody(localFile, output)
+    if closeErr := localFile.Close(); err == nil {
+        err = closeErr
+    }
+    if err != nil {
+        os.Remove(localFilePath)
+        return fmt.Errorf("failed to download %s: %v", s3Key, err)
+    }
+
+    if preserveXattrs {
+        err = restoreXattrs(s3Client, bucketName, s3Key, localFilePath, output.Metadata)
+        if err != nil {
+            return err
+        }
+    }
+
+    // Restore mode, ownership and mtime recorded at upload
+    return restoreFileMetadata(localFilePath, output.Metadata)
+}
+
+// copyObjectBody writes the original file content of a downloaded object to
+// dst, undoing client-side encryption and, with --decompress, compression.
+func copyObjectBody(dst io.Writer, output *s3.GetObjectOutput) error {
+    var body io.Reader = output.Body
+    if _, encrypted := metaValue(output.Metadata, metaEncryption); encrypted {
+        decrypted := decryptingReader(output.Body, output.Metadata)
+        defer decrypted.Close()
+        body = decrypted
+    }
+
+    if codec, ok := metaValue(output.Metadata, metaCompression); ok && decompressFiles {
+        decompressed, err := decompressingReader(body, codec)
+        if err != nil {
+            return err
+        }
+        defer decompressed.Close()
+        body = decompressed
+    }
+
+    _, err := io.Copy(dst, body)
     return err
-}
\ No newline at end of file
+}
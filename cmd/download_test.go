@@ -18,6 +18,8 @@ import (
 )
 
 func TestDownloadToLocal(t *testing.T) {
+    testcontainers.SkipIfProviderIsNotHealthy(t)
+
     ctx := context.Background()
 
     req := testcontainers.ContainerRequest{
@@ -55,6 +57,8 @@ func TestDownloadToLocal(t *testing.T) {
     // Set the endpointURL and region
     endpointURL = endpoint
     region = "us-east-1"
+    accessKeyID = "test"
+    secretAccessKey = "test"
 
     // Set the bucket name
     bucketName = "test-bucket"
@@ -180,6 +184,8 @@ func TestDownloadToLocal(t *testing.T) {
 
     // Now run download with deletion of extra local files
     deleteExtra = true
+    assumeYes = true
+    defer func() { assumeYes = false }()
     err = downloadToLocal(bucketName, outputDir)
     if err != nil {
         t.Fatalf("downloadToLocal with deleteExtra failed: %v", err)
@@ -0,0 +1,311 @@
+package cmd
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"golang.org/x/crypto/scrypt"
+)
+
+// User metadata written on client-side encrypted objects. metaEncryption names
+// the format; the data key is stored wrapped by the master key, and the MD5 of
+// the plaintext is stored encrypted under the data key so that change
+// detection works without revealing it.
+const (
+	metaEncryption    = "s3sync-enc"
+	metaEncryptionKey = "s3sync-enc-key"
+	metaEncryptionMD5 = "s3sync-enc-md5"
+	metaEncryptionKDF = "s3sync-enc-salt"
+)
+
+// encryptionScheme is AES-256-GCM over 64 KiB chunks, each sealed with a nonce
+// made of its index and a final-chunk flag so that chunks cannot be
+// reordered, dropped or truncated without detection. Every object gets a fresh
+// data key, so the nonces never repeat under the same key.
+const (
+	encryptionScheme = "aes-256-gcm-64k"
+	encryptChunkSize = 64 * 1024
+)
+
+var (
+	encryptContent        bool
+	encryptKeyFile        string
+	encryptPassphraseFile string
+
+	// masterKey is read from --encrypt-key-file; passphrase from
+	// --encrypt-passphrase-file.
+	masterKey  []byte
+	passphrase []byte
+
+	// uploadSalt is generated once per run so the passphrase only goes
+	// through scrypt once; derivedKeys caches the keys seen on download.
+	uploadSalt  []byte
+	derivedKeys map[string][]byte
+)
+
+// loadEncryptionConfig validates the client-side encryption flags and reads
+// the master key or passphrase.
+func loadEncryptionConfig() error {
+	masterKey, passphrase, uploadSalt = nil, nil, nil
+	derivedKeys = make(map[string][]byte)
+
+	if encryptKeyFile != "" && encryptPassphraseFile != "" {
+		return fmt.Errorf("--encrypt-key-file and --encrypt-passphrase-file cannot be combined")
+	}
+	if encryptContent && encryptKeyFile == "" && encryptPassphraseFile == "" {
+		return fmt.Errorf("--encrypt requires --encrypt-key-file or --encrypt-passphrase-file")
+	}
+	// Link targets and attributes are stored in object metadata and sidecars,
+	// which only the file contents are encrypted in
+	if encryptContent && symlinkPolicy == symlinksPreserve {
+		return fmt.Errorf("--encrypt cannot be combined with --symlinks=preserve, which stores link targets unencrypted")
+	}
+	if encryptContent && preserveXattrs {
+		return fmt.Errorf("--encrypt cannot be combined with --xattrs, which stores attributes unencrypted")
+	}
+
+	if encryptKeyFile != "" {
+		key, err := readKeyFile(encryptKeyFile)
+		if err != nil {
+			return fmt.Errorf("invalid encryption key: %v", err)
+		}
+		masterKey = key
+	}
+
+	if encryptPassphraseFile != "" {
+		data, err := os.ReadFile(encryptPassphraseFile)
+		if err != nil {
+			return fmt.Errorf("failed to read passphrase: %v", err)
+		}
+		passphrase = []byte(strings.TrimRight(string(data), "\r\n"))
+		if len(passphrase) == 0 {
+			return fmt.Errorf("passphrase file %s is empty", encryptPassphraseFile)
+		}
+		if encryptContent {
+			uploadSalt = make([]byte, 16)
+			if _, err := rand.Read(uploadSalt); err != nil {
+				return err
+			}
+		}
+	}
+
+	return loadKeyNameConfig()
+}
+
+// deriveKey turns the passphrase into a key-encryption key for salt.
+func deriveKey(salt []byte) ([]byte, error) {
+	if key, ok := derivedKeys[string(salt)]; ok {
+		return key, nil
+	}
+	key, err := scrypt.Key(passphrase, salt, 1<<15, 8, 1, 32)
+	if err != nil {
+		return nil, err
+	}
+	derivedKeys[string(salt)] = key
+	return key, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptStream encrypts src into dst under a new data key and records the
+// wrapped key and the encrypted plaintext checksum in meta.
+func encryptStream(dst io.Writer, src io.Reader, meta map[string]*string, checksum string) error {
+	kek := masterKey
+	if kek == nil {
+		var err error
+		if kek, err = deriveKey(uploadSalt); err != nil {
+			return err
+		}
+		meta[metaEncryptionKDF] = aws.String(base64.StdEncoding.EncodeToString(uploadSalt))
+	}
+
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return err
+	}
+
+	wrap, err := newGCM(kek)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, wrap.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	wrapped := wrap.Seal(nonce, nonce, dataKey, nil)
+
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return err
+	}
+	sealedMD5 := aead.Seal(nil, checksumNonce(aead), []byte(checksum), nil)
+
+	meta[metaEncryption] = aws.String(encryptionScheme)
+	meta[metaEncryptionKey] = aws.String(base64.StdEncoding.EncodeToString(wrapped))
+	meta[metaEncryptionMD5] = aws.String(base64.StdEncoding.EncodeToString(sealedMD5))
+
+	buf := make([]byte, encryptChunkSize)
+	reader := bufio.NewReaderSize(src, encryptChunkSize)
+	for index := uint32(0); ; index++ {
+		n, err := io.ReadFull(reader, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		last := n < len(buf)
+		if !last {
+			_, peekErr := reader.Peek(1)
+			last = peekErr == io.EOF
+		}
+		if _, err := dst.Write(aead.Seal(nil, chunkNonce(aead, index, last), buf[:n], nil)); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+// decryptStream reverses encryptStream, failing if the content was modified
+// or truncated.
+func decryptStream(dst io.Writer, src io.Reader, meta map[string]*string) error {
+	aead, err := objectCipher(meta)
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, encryptChunkSize+aead.Overhead())
+	reader := bufio.NewReaderSize(src, len(buf))
+	for index := uint32(0); ; index++ {
+		n, err := io.ReadFull(reader, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		last := n < len(buf)
+		if !last {
+			_, peekErr := reader.Peek(1)
+			last = peekErr == io.EOF
+		}
+		plain, err := aead.Open(nil, chunkNonce(aead, index, last), buf[:n], nil)
+		if err != nil {
+			return fmt.Errorf("failed to decrypt: content is corrupt or was modified")
+		}
+		if _, err := dst.Write(plain); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+// decryptingReader streams the plaintext of an encrypted object body.
+func decryptingReader(src io.Reader, meta map[string]*string) io.ReadCloser {
+	reader, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(decryptStream(writer, src, meta))
+	}()
+	return reader
+}
+
+// encryptedChecksum returns the plaintext MD5 recorded on a client-side
+// encrypted object. ok is false for objects that are not encrypted.
+func encryptedChecksum(meta map[string]*string) (checksum string, ok bool, err error) {
+	if _, encrypted := metaValue(meta, metaEncryption); !encrypted {
+		return "", false, nil
+	}
+	aead, err := objectCipher(meta)
+	if err != nil {
+		return "", true, err
+	}
+	value, _ := metaValue(meta, metaEncryptionMD5)
+	sealed, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return "", true, fmt.Errorf("invalid %s metadata", metaEncryptionMD5)
+	}
+	plain, err := aead.Open(nil, checksumNonce(aead), sealed, nil)
+	if err != nil {
+		return "", true, fmt.Errorf("failed to decrypt %s metadata", metaEncryptionMD5)
+	}
+	return string(plain), true, nil
+}
+
+// objectCipher unwraps the data key of an encrypted object.
+func objectCipher(meta map[string]*string) (cipher.AEAD, error) {
+	scheme, _ := metaValue(meta, metaEncryption)
+	if scheme != encryptionScheme {
+		return nil, fmt.Errorf("unsupported encryption scheme %q", scheme)
+	}
+
+	var kek []byte
+	if value, ok := metaValue(meta, metaEncryptionKDF); ok {
+		if passphrase == nil {
+			return nil, fmt.Errorf("object is encrypted with a passphrase; pass --encrypt-passphrase-file")
+		}
+		salt, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s metadata", metaEncryptionKDF)
+		}
+		if kek, err = deriveKey(salt); err != nil {
+			return nil, err
+		}
+	} else {
+		if masterKey == nil {
+			return nil, fmt.Errorf("object is encrypted with a key file; pass --encrypt-key-file")
+		}
+		kek = masterKey
+	}
+
+	value, _ := metaValue(meta, metaEncryptionKey)
+	wrapped, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s metadata", metaEncryptionKey)
+	}
+	wrap, err := newGCM(kek)
+	if err != nil {
+		return nil, err
+	}
+	if len(wrapped) < wrap.NonceSize() {
+		return nil, fmt.Errorf("invalid %s metadata", metaEncryptionKey)
+	}
+	dataKey, err := wrap.Open(nil, wrapped[:wrap.NonceSize()], wrapped[wrap.NonceSize():], nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap data key: wrong key or passphrase")
+	}
+	return newGCM(dataKey)
+}
+
+// chunkNonce is the big-endian chunk index followed by a flag byte that is 1
+// only for the final chunk.
+func chunkNonce(aead cipher.AEAD, index uint32, last bool) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint32(nonce[len(nonce)-5:], index)
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
+
+// checksumNonce cannot collide with a chunk nonce, whose leading bytes are
+// always zero.
+func checksumNonce(aead cipher.AEAD) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	for i := range nonce {
+		nonce[i] = 0xff
+	}
+	return nonce
+}
@@ -0,0 +1,156 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func resetEncryptionFlags() {
+	encryptContent, encryptKeyFile, encryptPassphraseFile = false, "", ""
+	masterKey, passphrase, uploadSalt, derivedKeys = nil, nil, nil, nil
+}
+
+// canonicalMeta mimics S3, which returns user metadata keys in canonical
+// header case.
+func canonicalMeta(meta map[string]*string) map[string]*string {
+	out := make(map[string]*string, len(meta))
+	for k, v := range meta {
+		out[http.CanonicalHeaderKey(k)] = v
+	}
+	return out
+}
+
+func TestEncryptStreamRoundTrip(t *testing.T) {
+	defer resetEncryptionFlags()
+	dir := t.TempDir()
+	keyPath := filepath.Join(dir, "master.key")
+	os.WriteFile(keyPath, bytes.Repeat([]byte{7}, 32), 0600)
+	passPath := filepath.Join(dir, "passphrase")
+	os.WriteFile(passPath, []byte("correct horse battery staple\n"), 0600)
+
+	for _, setup := range []func(){
+		func() { encryptKeyFile = keyPath },
+		func() { encryptPassphraseFile = passPath },
+	} {
+		for _, size := range []int{0, 1, encryptChunkSize, 3*encryptChunkSize + 17} {
+			resetEncryptionFlags()
+			encryptContent = true
+			setup()
+			if err := loadEncryptionConfig(); err != nil {
+				t.Fatalf("loadEncryptionConfig failed: %v", err)
+			}
+
+			plain := make([]byte, size)
+			rand.Read(plain)
+			meta := map[string]*string{}
+			var sealed bytes.Buffer
+			if err := encryptStream(&sealed, bytes.NewReader(plain), meta, "md5-of-plain"); err != nil {
+				t.Fatalf("encryptStream failed: %v", err)
+			}
+			if size > 16 && bytes.Contains(sealed.Bytes(), plain) {
+				t.Fatalf("Ciphertext contains the plaintext")
+			}
+			meta = canonicalMeta(meta)
+
+			// Download runs load the configuration without --encrypt
+			encryptContent = false
+			if err := loadEncryptionConfig(); err != nil {
+				t.Fatalf("loadEncryptionConfig failed: %v", err)
+			}
+
+			checksum, ok, err := encryptedChecksum(meta)
+			if err != nil || !ok || checksum != "md5-of-plain" {
+				t.Errorf("encryptedChecksum = %q, %v, %v", checksum, ok, err)
+			}
+
+			var out bytes.Buffer
+			if err := decryptStream(&out, bytes.NewReader(sealed.Bytes()), meta); err != nil {
+				t.Fatalf("decryptStream failed for %d bytes: %v", size, err)
+			}
+			if !bytes.Equal(out.Bytes(), plain) {
+				t.Errorf("Round trip of %d bytes changed the content", size)
+			}
+
+			// Dropping the final chunk must be detected
+			if size > encryptChunkSize {
+				truncated := sealed.Bytes()[:encryptChunkSize+16]
+				if err := decryptStream(&bytes.Buffer{}, bytes.NewReader(truncated), meta); err == nil {
+					t.Errorf("Expected truncated ciphertext to be rejected")
+				}
+			}
+		}
+	}
+}
+
+func TestDecryptStreamRejectsTampering(t *testing.T) {
+	defer resetEncryptionFlags()
+	dir := t.TempDir()
+	keyPath := filepath.Join(dir, "master.key")
+	os.WriteFile(keyPath, bytes.Repeat([]byte{7}, 32), 0600)
+	otherPath := filepath.Join(dir, "other.key")
+	os.WriteFile(otherPath, bytes.Repeat([]byte{8}, 32), 0600)
+
+	encryptContent, encryptKeyFile = true, keyPath
+	if err := loadEncryptionConfig(); err != nil {
+		t.Fatalf("loadEncryptionConfig failed: %v", err)
+	}
+	meta := map[string]*string{}
+	var sealed bytes.Buffer
+	if err := encryptStream(&sealed, bytes.NewReader([]byte("secret data")), meta, "x"); err != nil {
+		t.Fatalf("encryptStream failed: %v", err)
+	}
+
+	tampered := append([]byte(nil), sealed.Bytes()...)
+	tampered[0] ^= 1
+	if err := decryptStream(&bytes.Buffer{}, bytes.NewReader(tampered), meta); err == nil {
+		t.Errorf("Expected modified ciphertext to be rejected")
+	}
+
+	encryptKeyFile = otherPath
+	if err := loadEncryptionConfig(); err != nil {
+		t.Fatalf("loadEncryptionConfig failed: %v", err)
+	}
+	if err := decryptStream(&bytes.Buffer{}, bytes.NewReader(sealed.Bytes()), meta); err == nil {
+		t.Errorf("Expected the wrong master key to be rejected")
+	}
+
+	encryptContent, encryptKeyFile = false, ""
+	if err := loadEncryptionConfig(); err != nil {
+		t.Fatalf("loadEncryptionConfig failed: %v", err)
+	}
+	if _, _, err := encryptedChecksum(meta); err == nil {
+		t.Errorf("Expected an encrypted object to need a key")
+	}
+}
+
+func TestLoadEncryptionConfigErrors(t *testing.T) {
+	defer resetEncryptionFlags()
+
+	encryptContent = true
+	if err := loadEncryptionConfig(); err == nil {
+		t.Errorf("Expected --encrypt without a key to be rejected")
+	}
+
+	resetEncryptionFlags()
+	encryptKeyFile, encryptPassphraseFile = "a", "b"
+	if err := loadEncryptionConfig(); err == nil {
+		t.Errorf("Expected both key sources to be rejected")
+	}
+
+	// Neither would be encrypted
+	defer func() { symlinkPolicy, preserveXattrs = symlinksFollow, false }()
+	resetEncryptionFlags()
+	encryptContent, encryptKeyFile, symlinkPolicy = true, "a", symlinksPreserve
+	if err := loadEncryptionConfig(); err == nil || !strings.Contains(err.Error(), "--symlinks=preserve") {
+		t.Errorf("Expected --encrypt with --symlinks=preserve to be rejected, got %v", err)
+	}
+	symlinkPolicy, preserveXattrs = symlinksFollow, true
+	if err := loadEncryptionConfig(); err == nil || !strings.Contains(err.Error(), "--xattrs") {
+		t.Errorf("Expected --encrypt with --xattrs to be rejected, got %v", err)
+	}
+}
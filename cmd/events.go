@@ -0,0 +1,147 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+var (
+	notifySQSQueueURL string
+	notifySNSTopicARN string
+	notifyWebhookURL  string
+	notifyRetries     int
+	notifyEndpointURL string
+)
+
+// notifyBackoff is the delay before the first retry of a failed publish; it
+// doubles after every attempt.
+var notifyBackoff = time.Second
+
+// webhookClient posts change events. The timeout keeps an unresponsive
+// endpoint from hanging the run after the sync itself has finished.
+var webhookClient = &http.Client{Timeout: 30 * time.Second}
+
+// syncEvent is the change event published once a sync run has finished.
+type syncEvent struct {
+	RunID      string     `json:"runId"`
+	Operation  string     `json:"operation"`
+	Bucket     string     `json:"bucket"`
+	Prefix     string     `json:"prefix"`
+	Uploaded   []string   `json:"uploaded"`
+	Deleted    []string   `json:"deleted"`
+	Totals     syncTotals `json:"totals"`
+	StartedAt  time.Time  `json:"startedAt"`
+	FinishedAt time.Time  `json:"finishedAt"`
+}
+
+type syncTotals struct {
+	Scanned       int   `json:"scanned"`
+	Uploaded      int   `json:"uploaded"`
+	Skipped       int   `json:"skipped"`
+	Deleted       int   `json:"deleted"`
+	Transitioned  int   `json:"transitioned"`
+	BytesUploaded int64 `json:"bytesUploaded"`
+}
+
+// newRunID returns an identifier for a sync run that sorts by start time.
+func newRunID(start time.Time) string {
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		panic(err)
+	}
+	return start.UTC().Format("20060102T150405Z") + "-" + hex.EncodeToString(suffix)
+}
+
+func notificationsEnabled() bool {
+	return notifySQSQueueURL != "" || notifySNSTopicARN != "" || notifyWebhookURL != ""
+}
+
+// publishSyncEvent delivers event to every configured sink, retrying each one
+// independently.
+func publishSyncEvent(sess *session.Session, event *syncEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to encode change event: %v", err)
+	}
+
+	// SQS and SNS must not inherit the S3 endpoint override.
+	notifyConfig := &aws.Config{Endpoint: aws.String(notifyEndpointURL)}
+
+	var failed []error
+	if notifySQSQueueURL != "" {
+		err := withRetries(func() error {
+			_, err := sqs.New(sess, notifyConfig).SendMessage(&sqs.SendMessageInput{
+				QueueUrl:    aws.String(notifySQSQueueURL),
+				MessageBody: aws.String(string(body)),
+			})
+			return err
+		})
+		if err != nil {
+			failed = append(failed, fmt.Errorf("sqs %s: %v", notifySQSQueueURL, err))
+		}
+	}
+	if notifySNSTopicARN != "" {
+		err := withRetries(func() error {
+			_, err := sns.New(sess, notifyConfig).Publish(&sns.PublishInput{
+				TopicArn: aws.String(notifySNSTopicARN),
+				Subject:  aws.String(fmt.Sprintf("s3sync %s %s", event.Operation, event.Bucket)),
+				Message:  aws.String(string(body)),
+			})
+			return err
+		})
+		if err != nil {
+			failed = append(failed, fmt.Errorf("sns %s: %v", notifySNSTopicARN, err))
+		}
+	}
+	if notifyWebhookURL != "" {
+		err := withRetries(func() error {
+			return postWebhook(notifyWebhookURL, body)
+		})
+		if err != nil {
+			failed = append(failed, fmt.Errorf("webhook %s: %v", notifyWebhookURL, err))
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to publish change event for run %s: %v", event.RunID, failed)
+	}
+	return nil
+}
+
+func postWebhook(url string, body []byte) error {
+	resp, err := webhookClient.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+func withRetries(fn func() error) error {
+	delay := notifyBackoff
+	var err error
+	for attempt := 0; attempt <= notifyRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(delay)
+			delay *= 2
+		}
+		if err = fn(); err == nil {
+			return nil
+		}
+	}
+	return err
+}
@@ -0,0 +1,129 @@
+package cmd
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestPublishSyncEventWebhookRetries(t *testing.T) {
+	attempts := 0
+	var received syncEvent
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if err := json.NewDecoder(r.Body).Decode(&received); err != nil {
+			t.Errorf("Failed to decode event: %v", err)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	notifyWebhookURL = server.URL
+	notifyRetries = 3
+	notifyBackoff = time.Millisecond
+	defer func() { notifyWebhookURL = "" }()
+
+	event := &syncEvent{
+		RunID:     "run-1",
+		Operation: "upload",
+		Bucket:    "test-bucket",
+		Uploaded:  []string{"index.json"},
+		Deleted:   []string{"old.json"},
+	}
+	if err := publishSyncEvent(nil, event); err != nil {
+		t.Fatalf("publishSyncEvent failed: %v", err)
+	}
+
+	if attempts != 3 {
+		t.Errorf("Expected 3 delivery attempts, got %d", attempts)
+	}
+	if received.RunID != "run-1" || len(received.Uploaded) != 1 || received.Deleted[0] != "old.json" {
+		t.Errorf("Unexpected event received: %+v", received)
+	}
+}
+
+func TestPublishSyncEventWebhookGivesUp(t *testing.T) {
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	notifyWebhookURL = server.URL
+	notifyRetries = 2
+	notifyBackoff = time.Millisecond
+	defer func() { notifyWebhookURL = "" }()
+
+	if err := publishSyncEvent(nil, &syncEvent{RunID: "run-2"}); err == nil {
+		t.Fatal("Expected an error after exhausting retries")
+	}
+	if attempts != 3 {
+		t.Errorf("Expected 3 delivery attempts, got %d", attempts)
+	}
+}
+
+func TestPublishSyncEventSQSEndpoint(t *testing.T) {
+	// Change events must not go to the S3 endpoint
+	useFakeEndpoint(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("Unexpected request to the S3 endpoint: %s %s", r.Method, r.URL)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+
+	var received syncEvent
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request struct{ QueueUrl, MessageBody string }
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			t.Errorf("Failed to decode request: %v", err)
+		}
+		if err := json.Unmarshal([]byte(request.MessageBody), &received); err != nil {
+			t.Errorf("Failed to decode event: %v", err)
+		}
+		sum := md5.Sum([]byte(request.MessageBody))
+		json.NewEncoder(w).Encode(map[string]string{"MessageId": "1", "MD5OfMessageBody": hex.EncodeToString(sum[:])})
+	}))
+	defer server.Close()
+
+	notifySQSQueueURL = server.URL + "/000000000000/events"
+	notifyEndpointURL = server.URL
+	notifyRetries = 0
+	defer func() { notifySQSQueueURL, notifyEndpointURL = "", "" }()
+
+	sess, err := newSession()
+	if err != nil {
+		t.Fatalf("newSession failed: %v", err)
+	}
+	if err := publishSyncEvent(sess, &syncEvent{RunID: "run-3"}); err != nil {
+		t.Fatalf("publishSyncEvent failed: %v", err)
+	}
+	if received.RunID != "run-3" {
+		t.Errorf("Unexpected event received: %+v", received)
+	}
+}
+
+func TestPublishSyncEventWebhookTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	client := webhookClient
+	webhookClient = &http.Client{Timeout: 10 * time.Millisecond}
+	notifyWebhookURL = server.URL
+	notifyRetries = 0
+	defer func() { webhookClient, notifyWebhookURL = client, "" }()
+
+	if err := publishSyncEvent(nil, &syncEvent{RunID: "run-4"}); err == nil {
+		t.Fatal("Expected an unresponsive webhook to time out")
+	}
+}
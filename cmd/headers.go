@@ -0,0 +1,141 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"gopkg.in/yaml.v3"
+)
+
+var headerRulesFile string
+
+// headerRule sets HTTP headers on every uploaded object whose key matches
+// Pattern.
+type headerRule struct {
+	Pattern string            `yaml:"pattern"`
+	Headers map[string]string `yaml:"headers"`
+
+	glob *globPattern
+}
+
+var supportedHeaders = map[string]bool{
+	"Content-Type":        true,
+	"Cache-Control":       true,
+	"Content-Disposition": true,
+	"Content-Language":    true,
+	"Expires":             true,
+}
+
+// loadHeaderRules reads a YAML list of header rules. Rules are applied in
+// order, so later matches override earlier ones.
+func loadHeaderRules(path string) ([]headerRule, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read header rules: %v", err)
+	}
+
+	var rules []headerRule
+	if err := yaml.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("failed to parse header rules %s: %v", path, err)
+	}
+
+	for i := range rules {
+		rule := &rules[i]
+		if rule.Pattern == "" {
+			return nil, fmt.Errorf("header rule %d has no pattern", i+1)
+		}
+		rule.glob, err = compileGlob(rule.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %q in header rules: %v", rule.Pattern, err)
+		}
+
+		headers := make(map[string]string, len(rule.Headers))
+		for name, value := range rule.Headers {
+			canonical := http.CanonicalHeaderKey(name)
+			if !supportedHeaders[canonical] {
+				return nil, fmt.Errorf("unsupported header %q in rule for %q", name, rule.Pattern)
+			}
+			if canonical == "Expires" {
+				if _, err := parseExpires(value); err != nil {
+					return nil, fmt.Errorf("invalid Expires %q in rule for %q: %v", value, rule.Pattern, err)
+				}
+			}
+			headers[canonical] = value
+		}
+		rule.Headers = headers
+	}
+
+	return rules, nil
+}
+
+func parseExpires(value string) (time.Time, error) {
+	if t, err := http.ParseTime(value); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// detectContentType guesses the MIME type of a file from its extension,
+// falling back to sniffing its first 512 bytes.
+func detectContentType(filePath string) (string, error) {
+	if contentType := mime.TypeByExtension(filepath.Ext(filePath)); contentType != "" {
+		return contentType, nil
+	}
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	buf := make([]byte, 512)
+	n, err := io.ReadFull(file, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	return http.DetectContentType(buf[:n]), nil
+}
+
+// applyHeaders sets the detected Content-Type and any matching header rules
+// on an upload request.
+func applyHeaders(input *s3.PutObjectInput, rules []headerRule, key, filePath string) error {
+	contentType, err := detectContentType(filePath)
+	if err != nil {
+		return err
+	}
+	input.ContentType = aws.String(contentType)
+
+	for _, rule := range rules {
+		if !rule.glob.match(key) {
+			continue
+		}
+		for name, value := range rule.Headers {
+			switch name {
+			case "Content-Type":
+				input.ContentType = aws.String(value)
+			case "Cache-Control":
+				input.CacheControl = aws.String(value)
+			case "Content-Disposition":
+				input.ContentDisposition = aws.String(value)
+			case "Content-Language":
+				input.ContentLanguage = aws.String(value)
+			case "Expires":
+				expires, _ := parseExpires(value)
+				input.Expires = aws.Time(expires)
+			}
+		}
+	}
+
+	return nil
+}
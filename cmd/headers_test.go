@@ -0,0 +1,112 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestGlobPatternMatch(t *testing.T) {
+	cases := []struct {
+		pattern string
+		key     string
+		want    bool
+	}{
+		{"*.log", "app.log", true},
+		{"*.log", "logs/2024/app.log", true},
+		{"*.log", "app.log.gz", false},
+		{"archives/**", "archives/2024/data.tar", true},
+		{"archives/**", "other/archives/data.tar", false},
+		{"assets/*.css", "assets/site.css", true},
+		{"assets/*.css", "assets/vendor/site.css", false},
+		{"assets/**/*.css", "assets/site.css", true},
+		{"assets/**/*.css", "assets/vendor/site.css", true},
+		{"file?.txt", "file1.txt", true},
+		{"file?.txt", "file10.txt", false},
+		{"résumé/*", "résumé/a.txt", true},
+		{"résumé/*", "resume/a.txt", false},
+		{"r?sum?.pdf", "résumé.pdf", true},
+		{"*.日本", "docs/報告.日本", true},
+	}
+
+	for _, c := range cases {
+		glob, err := compileGlob(c.pattern)
+		if err != nil {
+			t.Fatalf("compileGlob(%q) failed: %v", c.pattern, err)
+		}
+		if got := glob.match(c.key); got != c.want {
+			t.Errorf("%q matching %q: expected %v, got %v", c.pattern, c.key, c.want, got)
+		}
+	}
+}
+
+func TestApplyHeaders(t *testing.T) {
+	dir := t.TempDir()
+	rulesPath := filepath.Join(dir, "rules.yaml")
+	os.WriteFile(rulesPath, []byte(`
+- pattern: "**"
+  headers:
+    cache-control: max-age=300
+- pattern: "assets/**"
+  headers:
+    Cache-Control: public, max-age=31536000, immutable
+- pattern: "*.csv"
+  headers:
+    Content-Disposition: attachment
+    Content-Language: en
+    Expires: "2030-01-01T00:00:00Z"
+`), 0644)
+
+	rules, err := loadHeaderRules(rulesPath)
+	if err != nil {
+		t.Fatalf("loadHeaderRules failed: %v", err)
+	}
+
+	files := map[string]string{
+		"assets/site.css": "body {}",
+		"report.csv":      "a,b\n1,2\n",
+		"noext":           "<html><body>hello</body></html>",
+	}
+	for name, content := range files {
+		os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0755)
+		os.WriteFile(filepath.Join(dir, name), []byte(content), 0644)
+	}
+
+	input := &s3.PutObjectInput{}
+	if err := applyHeaders(input, rules, "assets/site.css", filepath.Join(dir, "assets/site.css")); err != nil {
+		t.Fatalf("applyHeaders failed: %v", err)
+	}
+	if *input.ContentType != "text/css; charset=utf-8" {
+		t.Errorf("Unexpected Content-Type for css: %q", *input.ContentType)
+	}
+	if *input.CacheControl != "public, max-age=31536000, immutable" {
+		t.Errorf("Expected the later rule to override Cache-Control, got %q", *input.CacheControl)
+	}
+
+	input = &s3.PutObjectInput{}
+	if err := applyHeaders(input, rules, "report.csv", filepath.Join(dir, "report.csv")); err != nil {
+		t.Fatalf("applyHeaders failed: %v", err)
+	}
+	if *input.ContentDisposition != "attachment" || *input.ContentLanguage != "en" || input.Expires == nil {
+		t.Errorf("Expected csv headers to be applied, got %v", input)
+	}
+
+	input = &s3.PutObjectInput{}
+	if err := applyHeaders(input, nil, "noext", filepath.Join(dir, "noext")); err != nil {
+		t.Fatalf("applyHeaders failed: %v", err)
+	}
+	if *input.ContentType != "text/html; charset=utf-8" {
+		t.Errorf("Expected sniffed Content-Type, got %q", *input.ContentType)
+	}
+}
+
+func TestLoadHeaderRulesRejectsUnsupportedHeader(t *testing.T) {
+	rulesPath := filepath.Join(t.TempDir(), "rules.yaml")
+	os.WriteFile(rulesPath, []byte("- pattern: \"*\"\n  headers:\n    X-Custom: yes\n"), 0644)
+
+	if _, err := loadHeaderRules(rulesPath); err == nil {
+		t.Fatal("Expected an error for an unsupported header")
+	}
+}
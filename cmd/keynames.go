@@ -0,0 +1,154 @@
+package cmd
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base32"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// Key names are encrypted one path segment at a time, SIV style: the IV is an
+// HMAC of the segment and the segment is then encrypted with AES-CTR under
+// that IV. The same segment always yields the same name, so keys can be
+// compared without a lookup table, and decrypting re-checks the HMAC so that
+// keys written by anything else are recognised.
+var (
+	encryptKeys bool
+
+	// keyNameMAC and keyNameCipher are derived from the master key or
+	// passphrase by loadKeyNameConfig.
+	keyNameMAC    []byte
+	keyNameCipher cipher.Block
+)
+
+var keyNameEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+const keyNameIVSize = aes.BlockSize
+
+// loadKeyNameConfig derives the key name keys once loadEncryptionConfig has
+// read the master key or passphrase. The passphrase salt is fixed per bucket
+// because the names have to come out the same on every run.
+func loadKeyNameConfig() error {
+	keyNameMAC, keyNameCipher = nil, nil
+	if !encryptKeys {
+		return nil
+	}
+
+	base := masterKey
+	switch {
+	case masterKey != nil:
+	case passphrase != nil:
+		var err error
+		base, err = scrypt.Key(passphrase, []byte("s3sync key names:"+bucketName), 1<<15, 8, 1, 32)
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("--encrypt-keys requires --encrypt-key-file or --encrypt-passphrase-file")
+	}
+
+	keyNameMAC = deriveSubkey(base, "s3sync key name mac")
+	block, err := aes.NewCipher(deriveSubkey(base, "s3sync key name cipher"))
+	if err != nil {
+		return err
+	}
+	keyNameCipher = block
+	return nil
+}
+
+func deriveSubkey(key []byte, label string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(label))
+	return mac.Sum(nil)
+}
+
+// remoteKey returns the key an object is stored under. With --encrypt-keys
+// every non-empty path segment is encrypted, so a directory marker still ends
+// in "/".
+func remoteKey(key string) string {
+	if keyNameCipher == nil {
+		return key
+	}
+	segments := strings.Split(key, "/")
+	for i, segment := range segments {
+		if segment != "" {
+			segments[i] = encryptKeySegment(segment)
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// maxKeyBytes is the longest object key S3 accepts.
+const maxKeyBytes = 1024
+
+// checkKeyLength fails for a key whose stored form S3 would reject. With
+// --encrypt-keys that form is considerably longer than the key itself.
+func checkKeyLength(key string) error {
+	if n := len(remoteKey(key)); n > maxKeyBytes {
+		return fmt.Errorf("stored key is %d bytes, over the S3 limit of %d", n, maxKeyBytes)
+	}
+	return nil
+}
+
+// plainKey reverses remoteKey for a listed key.
+func plainKey(stored string) (string, error) {
+	if keyNameCipher == nil {
+		return stored, nil
+	}
+	segments := strings.Split(stored, "/")
+	for i, segment := range segments {
+		if segment == "" {
+			continue
+		}
+		plain, err := decryptKeySegment(segment)
+		if err != nil {
+			return "", err
+		}
+		segments[i] = plain
+	}
+	return strings.Join(segments, "/"), nil
+}
+
+func keySegmentIV(segment []byte) []byte {
+	mac := hmac.New(sha256.New, keyNameMAC)
+	mac.Write(segment)
+	return mac.Sum(nil)[:keyNameIVSize]
+}
+
+func encryptKeySegment(segment string) string {
+	iv := keySegmentIV([]byte(segment))
+	out := make([]byte, keyNameIVSize+len(segment))
+	copy(out, iv)
+	cipher.NewCTR(keyNameCipher, iv).XORKeyStream(out[keyNameIVSize:], []byte(segment))
+	return strings.ToLower(keyNameEncoding.EncodeToString(out))
+}
+
+func decryptKeySegment(segment string) (string, error) {
+	data, err := keyNameEncoding.DecodeString(strings.ToUpper(segment))
+	if err != nil || len(data) < keyNameIVSize {
+		return "", fmt.Errorf("%q is not an encrypted key name", segment)
+	}
+	iv := data[:keyNameIVSize]
+	plain := make([]byte, len(data)-keyNameIVSize)
+	cipher.NewCTR(keyNameCipher, iv).XORKeyStream(plain, data[keyNameIVSize:])
+	if !hmac.Equal(iv, keySegmentIV(plain)) {
+		return "", fmt.Errorf("%q was not encrypted with this key", segment)
+	}
+	return string(plain), nil
+}
+
+// listedKey maps a key from a bucket listing to the key it stands for,
+// reporting keys that cannot be decrypted so they are left alone.
+func listedKey(stored string) (string, bool) {
+	key, err := plainKey(stored)
+	if err != nil {
+		fmt.Printf("Skipped (key name not decryptable): %s\n", stored)
+		return "", false
+	}
+	return key, true
+}
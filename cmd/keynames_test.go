@@ -0,0 +1,103 @@
+package cmd
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRemoteKeyRoundTrip(t *testing.T) {
+	defer func() {
+		encryptKeys = false
+		resetEncryptionFlags()
+		loadKeyNameConfig()
+	}()
+	keyPath := filepath.Join(t.TempDir(), "master.key")
+	os.WriteFile(keyPath, bytes.Repeat([]byte{7}, 32), 0600)
+
+	if got := remoteKey("Customers/Acme/report.pdf"); got != "Customers/Acme/report.pdf" {
+		t.Errorf("Expected keys to be unchanged without --encrypt-keys, got %q", got)
+	}
+
+	encryptKeys, encryptKeyFile = true, keyPath
+	if err := loadEncryptionConfig(); err != nil {
+		t.Fatalf("loadEncryptionConfig failed: %v", err)
+	}
+
+	for _, key := range []string{"Customers/Acme/report.pdf", "Customers/Acme/", "a//b", "ünïcode.txt"} {
+		stored := remoteKey(key)
+		if stored == key || strings.Contains(stored, "Acme") {
+			t.Errorf("Key %q was not encrypted: %q", key, stored)
+		}
+		if strings.Count(stored, "/") != strings.Count(key, "/") {
+			t.Errorf("Expected %q to keep its segments, got %q", key, stored)
+		}
+		if again := remoteKey(key); again != stored {
+			t.Errorf("Expected deterministic names, got %q and %q", stored, again)
+		}
+		plain, err := plainKey(stored)
+		if err != nil || plain != key {
+			t.Errorf("plainKey(%q) = %q, %v; want %q", stored, plain, err, key)
+		}
+	}
+
+	// Shared prefixes encrypt to shared prefixes
+	a, b := remoteKey("Customers/Acme/a.txt"), remoteKey("Customers/Acme/b.txt")
+	if a[:strings.LastIndex(a, "/")] != b[:strings.LastIndex(b, "/")] {
+		t.Errorf("Expected the same directory to encrypt the same way: %q, %q", a, b)
+	}
+
+	if _, ok := listedKey("plain-name.txt"); ok {
+		t.Errorf("Expected a key written without encryption to be skipped")
+	}
+
+	os.WriteFile(keyPath, bytes.Repeat([]byte{8}, 32), 0600)
+	if err := loadEncryptionConfig(); err != nil {
+		t.Fatalf("loadEncryptionConfig failed: %v", err)
+	}
+	if _, err := plainKey(a); err == nil {
+		t.Errorf("Expected a key encrypted with another master key to be rejected")
+	}
+}
+
+func TestEncryptKeysRequiresKey(t *testing.T) {
+	defer func() {
+		encryptKeys = false
+		resetEncryptionFlags()
+	}()
+	encryptKeys = true
+	if err := loadEncryptionConfig(); err == nil {
+		t.Errorf("Expected --encrypt-keys without a key to be rejected")
+	}
+}
+
+func TestUploadSkipsKeysTooLongWhenEncrypted(t *testing.T) {
+	defer func() {
+		encryptKeys = false
+		resetEncryptionFlags()
+		loadKeyNameConfig()
+	}()
+	keyPath := filepath.Join(t.TempDir(), "master.key")
+	os.WriteFile(keyPath, bytes.Repeat([]byte{7}, 32), 0600)
+	encryptKeys, encryptKeyFile = true, keyPath
+
+	store := &fakeObjectStore{objects: map[string]string{}}
+	useFakeEndpoint(t, store)
+
+	// Ten 60-byte segments fit as they are, but not once encrypted
+	dir := t.TempDir()
+	deep := filepath.Join(strings.Split(strings.Repeat(strings.Repeat("d", 60)+"/", 10), "/")...)
+	os.MkdirAll(filepath.Join(dir, deep), 0755)
+	os.WriteFile(filepath.Join(dir, deep, "file.txt"), []byte("deep"), 0644)
+	os.WriteFile(filepath.Join(dir, "short.txt"), []byte("short"), 0644)
+
+	err := uploadToS3(dir, "bucket")
+	if err == nil || !strings.Contains(err.Error(), "too long") {
+		t.Fatalf("Expected the long key to be reported, got %v", err)
+	}
+	if got := store.keys(); len(got) != 1 || len(got[0]) > maxKeyBytes {
+		t.Errorf("Expected only short.txt to be uploaded, got %v", got)
+	}
+}
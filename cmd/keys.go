@@ -0,0 +1,143 @@
+package cmd
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+var (
+	normalizeUnicode bool
+	lowercaseKeys    bool
+	escapeKeys       bool
+)
+
+// localEntry is a scanned local file indexed by the object key it maps to.
+type localEntry struct {
+	Path     string // relative to the sync root, using the OS separator
+	Checksum string
+}
+
+// objectKey turns a path relative to the sync root into the object key it is
+// stored under: "/" separators, Unicode NFC so that NFD names from macOS
+// match NFC names from elsewhere, optionally lower case, and with bytes S3
+// cannot store escaped when --escape-keys is set.
+func objectKey(relativePath string) (string, error) {
+	key := filepath.ToSlash(relativePath)
+
+	if escapeKeys {
+		key = escapeKey(key)
+	} else if !utf8.ValidString(key) {
+		return "", fmt.Errorf("file name %q is not valid UTF-8 (use --escape-keys to store it)", relativePath)
+	}
+
+	return normalizeKey(key), nil
+}
+
+// normalizeKey applies the Unicode normalization and lower-casing of
+// objectKey to a key, so that keys listed from a bucket written by other
+// tools can be matched against local files.
+func normalizeKey(key string) string {
+	if normalizeUnicode {
+		key = norm.NFC.String(key)
+	}
+	if lowercaseKeys {
+		key = strings.ToLower(key)
+	}
+	return key
+}
+
+// localName reverses the escaping applied by objectKey. Unicode
+// normalization and lower-casing cannot be undone; existing local files are
+// matched through indexLocalFiles instead.
+func localName(key string) string {
+	if escapeKeys {
+		return unescapeKey(key)
+	}
+	return key
+}
+
+// indexLocalFiles keys scanned files by their object key. Two local files
+// that normalize to the same key cannot both be synced and are reported.
+func indexLocalFiles(files map[string]string) (map[string]localEntry, error) {
+	paths := make([]string, 0, len(files))
+	for relativePath := range files {
+		paths = append(paths, relativePath)
+	}
+	sort.Strings(paths)
+
+	index := make(map[string]localEntry, len(files))
+	var clashes []string
+	for _, relativePath := range paths {
+		key, err := objectKey(relativePath)
+		if err != nil {
+			return nil, err
+		}
+		if existing, ok := index[key]; ok {
+			clashes = append(clashes, fmt.Sprintf("%s and %s both map to key %s", existing.Path, relativePath, key))
+			continue
+		}
+		index[key] = localEntry{Path: relativePath, Checksum: files[relativePath]}
+	}
+
+	if len(clashes) > 0 {
+		return nil, fmt.Errorf("local files collide after key normalization:\n  %s", strings.Join(clashes, "\n  "))
+	}
+	return index, nil
+}
+
+// escapeKey percent-escapes bytes that are not valid UTF-8. A "%" that would
+// otherwise read as an escape sequence is escaped too, so unescapeKey
+// restores the exact original bytes while ordinary names stay unchanged.
+func escapeKey(name string) string {
+	var b strings.Builder
+	for i := 0; i < len(name); {
+		r, size := utf8.DecodeRuneInString(name[i:])
+		switch {
+		case r == utf8.RuneError && size == 1:
+			fmt.Fprintf(&b, "%%%02X", name[i])
+		case r == '%' && isEscapeSequence(name[i:]):
+			b.WriteString("%25")
+		default:
+			b.WriteString(name[i : i+size])
+		}
+		i += size
+	}
+	return b.String()
+}
+
+func unescapeKey(key string) string {
+	var b strings.Builder
+	for i := 0; i < len(key); i++ {
+		if key[i] == '%' && isEscapeSequence(key[i:]) {
+			b.WriteByte(unhex(key[i+1])<<4 | unhex(key[i+2]))
+			i += 2
+			continue
+		}
+		b.WriteByte(key[i])
+	}
+	return b.String()
+}
+
+func isEscapeSequence(s string) bool {
+	return len(s) >= 3 && s[0] == '%' && isHex(s[1]) && isHex(s[2])
+}
+
+func isHex(c byte) bool {
+	return ('0' <= c && c <= '9') || ('a' <= c && c <= 'f') || ('A' <= c && c <= 'F')
+}
+
+func unhex(c byte) byte {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0'
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10
+	default:
+		return c - 'A' + 10
+	}
+}
@@ -0,0 +1,112 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEscapeKeyRoundTrip(t *testing.T) {
+	names := []string{
+		"plain.txt",
+		"100%.txt",
+		"%41 literal",
+		"%zz",
+		"bad\xff\xfebytes",
+		"%\xff",
+		"mixed/é/%2F/\x80",
+	}
+	for _, name := range names {
+		escaped := escapeKey(name)
+		if got := unescapeKey(escaped); got != name {
+			t.Errorf("Round trip of %q via %q gave %q", name, escaped, got)
+		}
+	}
+
+	if escapeKey("100%.txt") != "100%.txt" {
+		t.Errorf("Expected names without escape sequences to be unchanged")
+	}
+	if escapeKey("bad\xffbyte") != "bad%FFbyte" {
+		t.Errorf("Unexpected escaping: %q", escapeKey("bad\xffbyte"))
+	}
+}
+
+func TestObjectKeyNormalization(t *testing.T) {
+	defer func() { normalizeUnicode, lowercaseKeys, escapeKeys = true, false, false }()
+	normalizeUnicode, lowercaseKeys, escapeKeys = true, false, false
+
+	nfd := "Cafe\u0301.txt"
+	key, err := objectKey(filepath.Join("Menu", nfd))
+	if err != nil {
+		t.Fatalf("objectKey failed: %v", err)
+	}
+	if key != "Menu/Caf\u00e9.txt" {
+		t.Errorf("Expected NFC key with / separator, got %q", key)
+	}
+
+	if _, err := objectKey("bad\xffname"); err == nil {
+		t.Errorf("Expected invalid UTF-8 to be rejected without --escape-keys")
+	}
+
+	lowercaseKeys, escapeKeys = true, true
+	key, err = objectKey("Data/Bad\xffName.TXT")
+	if err != nil {
+		t.Fatalf("objectKey failed: %v", err)
+	}
+	if key != "data/bad%ffname.txt" {
+		t.Errorf("Unexpected key %q", key)
+	}
+}
+
+func TestIndexLocalFilesDetectsCollisions(t *testing.T) {
+	defer func() { normalizeUnicode = true }()
+	normalizeUnicode = true
+
+	files := map[string]string{
+		"Caf\u00e9.txt":  "a",
+		"Cafe\u0301.txt": "b",
+	}
+	if _, err := indexLocalFiles(files); err == nil {
+		t.Fatal("Expected NFC and NFD names to collide")
+	}
+
+	normalizeUnicode = false
+	index, err := indexLocalFiles(files)
+	if err != nil {
+		t.Fatalf("indexLocalFiles failed: %v", err)
+	}
+	if len(index) != 2 {
+		t.Errorf("Expected two keys without normalization, got %v", index)
+	}
+}
+
+func TestDownloadMatchesNormalizedKeys(t *testing.T) {
+	defer func() { deleteExtra, assumeYes = false, false }()
+
+	// Other tools stored the key in NFD and NFC, while the local name is NFC
+	store := &fakeObjectStore{objects: map[string]string{"Cafe\u0301.txt": "old menu", "Caf\u00e9.txt": "menu"}}
+	useFakeEndpoint(t, store)
+
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "Caf\u00e9.txt"), []byte("old"), 0644)
+	os.WriteFile(filepath.Join(dir, "bad\xffname.txt"), []byte("kept"), 0644)
+
+	deleteExtra, assumeYes = true, true
+	for run := 0; run < 2; run++ {
+		if err := downloadToLocal("bucket", dir); err != nil {
+			t.Fatalf("downloadToLocal failed: %v", err)
+		}
+	}
+
+	entries, _ := os.ReadDir(dir)
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	if len(names) != 2 || names[0] != "Caf\u00e9.txt" || names[1] != "bad\xffname.txt" {
+		t.Errorf("Expected the local files to be left as they were, got %q", names)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dir, "Caf\u00e9.txt")); string(data) != "menu" {
+		t.Errorf("Expected the normalized key to be downloaded, got %q", data)
+	}
+}
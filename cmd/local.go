@@ -0,0 +1,249 @@
+package cmd
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Symlink policies accepted by --symlinks.
+const (
+	symlinksSkip     = "skip"
+	symlinksFollow   = "follow"
+	symlinksPreserve = "preserve"
+)
+
+// metaSymlink marks an object that stands for a symbolic link. Its value is
+// the path-escaped link target, which is also stored as the object body so
+// that the ETag changes when the target does.
+const metaSymlink = "s3sync-symlink"
+
+// emptyDirChecksum is the MD5 of an empty body, which is the ETag of a
+// directory marker object.
+var emptyDirChecksum = md5String("")
+
+var (
+	symlinkPolicy string
+	dirMarkers    bool
+)
+
+func validateSymlinkPolicy() error {
+	switch symlinkPolicy {
+	case symlinksSkip, symlinksFollow, symlinksPreserve:
+		return nil
+	}
+	return fmt.Errorf("invalid --symlinks value %q (want skip, follow or preserve)", symlinkPolicy)
+}
+
+// scanLocalFiles returns the MD5 checksum of every file under root, keyed by
+// its path relative to root. Symbolic links are handled according to
+// --symlinks; a preserved link is checksummed by its target path. With
+// --dir-markers, empty directories are included with a trailing "/".
+func scanLocalFiles(root string) (map[string]string, error) {
+	if err := validateSymlinkPolicy(); err != nil {
+		return nil, err
+	}
+
+	rootInfo, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+
+	files := make(map[string]string)
+	err = scanDir(root, "", []os.FileInfo{rootInfo}, files)
+	return files, err
+}
+
+// scanDir walks one directory. ancestors holds the directories on the current
+// path so that following a symlink back into one of them is detected as a
+// loop instead of recursing forever.
+func scanDir(root, relDir string, ancestors []os.FileInfo, files map[string]string) error {
+	entries, err := os.ReadDir(filepath.Join(root, relDir))
+	if err != nil {
+		return err
+	}
+
+	if len(entries) == 0 && relDir != "" && dirMarkers {
+		files[filepath.ToSlash(relDir)+"/"] = emptyDirChecksum
+		return nil
+	}
+
+	for _, entry := range entries {
+		// Local state such as pending restores is never synced, and a local
+		// trash directory would land in the bucket's trash
+		if relDir == "" && isInternalKey(entry.Name()+"/") {
+			continue
+		}
+
+		relativePath := filepath.Join(relDir, entry.Name())
+		fullPath := filepath.Join(root, relativePath)
+
+		info, err := os.Lstat(fullPath)
+		if err != nil {
+			return err
+		}
+
+		if info.Mode()&os.ModeSymlink != 0 {
+			switch symlinkPolicy {
+			case symlinksSkip:
+				fmt.Printf("Skipped (symlink): %s\n", relativePath)
+				continue
+			case symlinksPreserve:
+				target, err := os.Readlink(fullPath)
+				if err != nil {
+					return err
+				}
+				files[relativePath] = md5String(target)
+				continue
+			}
+
+			info, err = os.Stat(fullPath)
+			if err != nil {
+				fmt.Printf("Skipped (broken symlink): %s\n", relativePath)
+				continue
+			}
+			if info.IsDir() && isAncestor(info, ancestors) {
+				fmt.Printf("Skipped (symlink loop): %s\n", relativePath)
+				continue
+			}
+		}
+
+		switch {
+		case info.IsDir():
+			if err := scanDir(root, relativePath, append(ancestors, info), files); err != nil {
+				return err
+			}
+		case info.Mode().IsRegular():
+			checksum, err := computeMD5Checksum(fullPath)
+			if err != nil {
+				return err
+			}
+			files[relativePath] = checksum
+		default:
+			fmt.Printf("Skipped (not a regular file): %s\n", relativePath)
+		}
+	}
+
+	return nil
+}
+
+func isAncestor(dir os.FileInfo, ancestors []os.FileInfo) bool {
+	for _, ancestor := range ancestors {
+		if os.SameFile(dir, ancestor) {
+			return true
+		}
+	}
+	return false
+}
+
+func md5String(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// uploadSymlink stores a symbolic link as an object whose body is the link
+// target.
+func uploadSymlink(s3Client *s3.S3, bucketName, key, filePath string) error {
+	target, err := os.Readlink(filePath)
+	if err != nil {
+		return err
+	}
+
+	input := &s3.PutObjectInput{
+		Bucket:      aws.String(bucketName),
+		Key:         aws.String(remoteKey(key)),
+		Body:        strings.NewReader(target),
+		ContentType: aws.String("text/plain; charset=utf-8"),
+		Metadata: map[string]*string{
+			metaSymlink: aws.String(url.PathEscape(target)),
+			metaMD5:     aws.String(md5String(target)),
+		},
+	}
+	applySSE(input)
+	applyACL(input)
+	applyStorageClass(input, key)
+	if err := applyTags(input, key); err != nil {
+		return err
+	}
+
+	_, err = s3Client.PutObject(input)
+	return err
+}
+
+// symlinkTarget returns the link target recorded on an object, if it stands
+// for a symbolic link.
+func symlinkTarget(meta map[string]*string) (string, bool, error) {
+	value, ok := metaValue(meta, metaSymlink)
+	if !ok {
+		return "", false, nil
+	}
+	target, err := url.PathUnescape(value)
+	if err != nil {
+		return "", false, fmt.Errorf("invalid %s metadata %q: %v", metaSymlink, value, err)
+	}
+	return target, true, nil
+}
+
+// createSymlink replaces whatever is at localPath with a link to target.
+func createSymlink(target, localPath string) error {
+	if err := os.Remove(localPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.Symlink(target, localPath)
+}
+
+func isDirMarker(key string) bool {
+	return strings.HasSuffix(key, "/")
+}
+
+// dirExists reports whether the directory a marker key stands for is already
+// present locally, in which case there is nothing to download.
+func dirExists(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
+
+// uploadDirMarker stores an empty directory as a zero-byte "dir/" object.
+func uploadDirMarker(s3Client *s3.S3, bucketName, key string) error {
+	input := &s3.PutObjectInput{
+		Bucket:      aws.String(bucketName),
+		Key:         aws.String(remoteKey(key)),
+		Body:        strings.NewReader(""),
+		ContentType: aws.String("application/x-directory"),
+		Metadata: map[string]*string{
+			metaMD5: aws.String(emptyDirChecksum),
+		},
+	}
+	applySSE(input)
+	applyACL(input)
+	if err := applyTags(input, key); err != nil {
+		return err
+	}
+
+	_, err := s3Client.PutObject(input)
+	return err
+}
+
+// pruneEmptyDirs removes the parent directories of relativePath that became
+// empty, stopping at root or at a directory that is kept by a marker object.
+func pruneEmptyDirs(root, relativePath string, keep map[string]string) {
+	dir := filepath.Dir(strings.TrimSuffix(relativePath, "/"))
+	for dir != "." && dir != string(filepath.Separator) {
+		if _, marked := keep[filepath.ToSlash(dir)+"/"]; marked {
+			return
+		}
+		if err := os.Remove(filepath.Join(root, dir)); err != nil {
+			// Not empty, or already gone
+			return
+		}
+		fmt.Printf("Deleted empty directory: %s\n", dir)
+		dir = filepath.Dir(dir)
+	}
+}
@@ -0,0 +1,125 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// makeSymlinkTree creates:
+//
+//	data/file.txt
+//	link.txt -> data/file.txt
+//	linkdir  -> data
+//	data/loop -> ..
+func makeSymlinkTree(t *testing.T) string {
+	root := t.TempDir()
+	os.Mkdir(filepath.Join(root, "data"), 0755)
+	os.WriteFile(filepath.Join(root, "data", "file.txt"), []byte("content"), 0644)
+	for link, target := range map[string]string{
+		"link.txt":  filepath.Join("data", "file.txt"),
+		"linkdir":   "data",
+		"data/loop": "..",
+	} {
+		if err := os.Symlink(target, filepath.Join(root, link)); err != nil {
+			t.Skipf("Symlinks not supported: %v", err)
+		}
+	}
+	return root
+}
+
+func scanWithPolicy(t *testing.T, root, policy string) map[string]string {
+	symlinkPolicy = policy
+	defer func() { symlinkPolicy = symlinksFollow }()
+
+	files, err := scanLocalFiles(root)
+	if err != nil {
+		t.Fatalf("scanLocalFiles with %s failed: %v", policy, err)
+	}
+	return files
+}
+
+func TestScanLocalFilesSymlinkPolicies(t *testing.T) {
+	root := makeSymlinkTree(t)
+	contentSum := md5String("content")
+
+	skipped := scanWithPolicy(t, root, symlinksSkip)
+	if len(skipped) != 1 || skipped[filepath.Join("data", "file.txt")] != contentSum {
+		t.Errorf("skip: expected only data/file.txt, got %v", skipped)
+	}
+
+	followed := scanWithPolicy(t, root, symlinksFollow)
+	for _, key := range []string{
+		filepath.Join("data", "file.txt"),
+		"link.txt",
+		filepath.Join("linkdir", "file.txt"),
+	} {
+		if followed[key] != contentSum {
+			t.Errorf("follow: expected %s with the file's checksum, got %v", key, followed)
+		}
+	}
+	if len(followed) != 3 {
+		t.Errorf("follow: expected loops to be cut off, got %v", followed)
+	}
+
+	preserved := scanWithPolicy(t, root, symlinksPreserve)
+	if preserved["link.txt"] != md5String(filepath.Join("data", "file.txt")) {
+		t.Errorf("preserve: expected link.txt to be checksummed by its target, got %v", preserved)
+	}
+	if preserved["linkdir"] != md5String("data") || preserved[filepath.Join("data", "loop")] != md5String("..") {
+		t.Errorf("preserve: expected directory links to be kept as links, got %v", preserved)
+	}
+}
+
+func TestScanLocalFilesRejectsUnknownPolicy(t *testing.T) {
+	symlinkPolicy = "copy"
+	defer func() { symlinkPolicy = symlinksFollow }()
+
+	if _, err := scanLocalFiles(t.TempDir()); err == nil {
+		t.Fatal("Expected an error for an unknown symlink policy")
+	}
+}
+
+func TestScanLocalFilesDirMarkers(t *testing.T) {
+	root := t.TempDir()
+	os.MkdirAll(filepath.Join(root, "empty", "nested"), 0755)
+	os.MkdirAll(filepath.Join(root, "full"), 0755)
+	os.WriteFile(filepath.Join(root, "full", "file.txt"), []byte("content"), 0644)
+
+	dirMarkers = true
+	defer func() { dirMarkers = false }()
+
+	files, err := scanLocalFiles(root)
+	if err != nil {
+		t.Fatalf("scanLocalFiles failed: %v", err)
+	}
+	if files["empty/nested/"] != emptyDirChecksum {
+		t.Errorf("Expected a marker for empty/nested/, got %v", files)
+	}
+	if _, ok := files["empty/"]; ok {
+		t.Errorf("Did not expect a marker for non-empty directory empty/")
+	}
+	if _, ok := files["full/"]; ok {
+		t.Errorf("Did not expect a marker for non-empty directory full/")
+	}
+}
+
+func TestPruneEmptyDirs(t *testing.T) {
+	root := t.TempDir()
+	os.MkdirAll(filepath.Join(root, "a", "b", "c"), 0755)
+	os.MkdirAll(filepath.Join(root, "kept", "gone"), 0755)
+	os.WriteFile(filepath.Join(root, "a", "other.txt"), []byte("x"), 0644)
+
+	pruneEmptyDirs(root, filepath.Join("a", "b", "c", "deleted.txt"), nil)
+	if _, err := os.Stat(filepath.Join(root, "a", "b")); !os.IsNotExist(err) {
+		t.Errorf("Expected a/b to be pruned")
+	}
+	if _, err := os.Stat(filepath.Join(root, "a")); err != nil {
+		t.Errorf("Expected a to be kept since it is not empty")
+	}
+
+	pruneEmptyDirs(root, filepath.Join("kept", "gone", "deleted.txt"), map[string]string{"kept/": emptyDirChecksum})
+	if _, err := os.Stat(filepath.Join(root, "kept")); err != nil {
+		t.Errorf("Expected kept to survive because of its marker")
+	}
+}
@@ -0,0 +1,128 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// User metadata keys written on upload. S3 returns them with canonicalized
+// case, so they are always read back through metaValue.
+const (
+	metaMtime = "s3sync-mtime"
+	metaMode  = "s3sync-mode"
+	metaUID   = "s3sync-uid"
+	metaGID   = "s3sync-gid"
+)
+
+var noRestoreOwner bool
+
+// runningAsRoot reports whether ownership can be restored. Only root may give
+// files away, so other users skip it. Tests replace it.
+var runningAsRoot = func() bool {
+	return os.Geteuid() == 0
+}
+
+// fileMetadata describes the POSIX attributes of a local file as object user
+// metadata.
+func fileMetadata(info os.FileInfo) map[string]*string {
+	meta := map[string]*string{
+		metaMtime: aws.String(info.ModTime().UTC().Format(time.RFC3339Nano)),
+		metaMode:  aws.String(fmt.Sprintf("%04o", unixMode(info.Mode()))),
+	}
+	if uid, gid, ok := fileOwner(info); ok {
+		meta[metaUID] = aws.String(strconv.Itoa(uid))
+		meta[metaGID] = aws.String(strconv.Itoa(gid))
+	}
+	return meta
+}
+
+// metaValue looks up a user metadata key case-insensitively.
+func metaValue(meta map[string]*string, key string) (string, bool) {
+	for k, v := range meta {
+		if strings.EqualFold(k, key) && v != nil {
+			return *v, true
+		}
+	}
+	return "", false
+}
+
+// restoreFileMetadata applies the mode, ownership and modification time
+// recorded by fileMetadata to a downloaded file. Objects uploaded by other
+// tools carry none of these keys and are left untouched.
+func restoreFileMetadata(path string, meta map[string]*string) error {
+	// Changing the owner clears the setuid and setgid bits, so the mode is
+	// applied after it
+	if !noRestoreOwner && runningAsRoot() {
+		uidValue, hasUID := metaValue(meta, metaUID)
+		gidValue, hasGID := metaValue(meta, metaGID)
+		if hasUID && hasGID {
+			uid, err := strconv.Atoi(uidValue)
+			if err != nil {
+				return fmt.Errorf("invalid %s metadata %q: %v", metaUID, uidValue, err)
+			}
+			gid, err := strconv.Atoi(gidValue)
+			if err != nil {
+				return fmt.Errorf("invalid %s metadata %q: %v", metaGID, gidValue, err)
+			}
+			if err := chownFile(path, uid, gid); err != nil {
+				return fmt.Errorf("failed to restore ownership of %s (use --no-owner to skip it): %v", path, err)
+			}
+		}
+	}
+
+	if value, ok := metaValue(meta, metaMode); ok {
+		mode, err := strconv.ParseUint(value, 8, 32)
+		if err != nil {
+			return fmt.Errorf("invalid %s metadata %q: %v", metaMode, value, err)
+		}
+		if err := os.Chmod(path, fileModeFromUnix(uint32(mode))); err != nil {
+			return err
+		}
+	}
+
+	if value, ok := metaValue(meta, metaMtime); ok {
+		mtime, err := time.Parse(time.RFC3339Nano, value)
+		if err != nil {
+			return fmt.Errorf("invalid %s metadata %q: %v", metaMtime, value, err)
+		}
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// unixMode converts a FileMode to traditional Unix permission bits.
+func unixMode(mode os.FileMode) uint32 {
+	bits := uint32(mode.Perm())
+	if mode&os.ModeSetuid != 0 {
+		bits |= 0o4000
+	}
+	if mode&os.ModeSetgid != 0 {
+		bits |= 0o2000
+	}
+	if mode&os.ModeSticky != 0 {
+		bits |= 0o1000
+	}
+	return bits
+}
+
+func fileModeFromUnix(bits uint32) os.FileMode {
+	mode := os.FileMode(bits & 0o777)
+	if bits&0o4000 != 0 {
+		mode |= os.ModeSetuid
+	}
+	if bits&0o2000 != 0 {
+		mode |= os.ModeSetgid
+	}
+	if bits&0o1000 != 0 {
+		mode |= os.ModeSticky
+	}
+	return mode
+}
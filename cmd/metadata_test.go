@@ -0,0 +1,123 @@
+package cmd
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+func TestFileMetadataRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "build.sh")
+	dst := filepath.Join(dir, "restored.sh")
+	os.WriteFile(src, []byte("#!/bin/sh\n"), 0644)
+	os.WriteFile(dst, []byte("#!/bin/sh\n"), 0644)
+
+	if err := os.Chmod(src, 0750); err != nil {
+		t.Fatalf("Failed to chmod: %v", err)
+	}
+	mtime := time.Date(2020, 5, 17, 10, 30, 0, 123456789, time.UTC)
+	if err := os.Chtimes(src, mtime, mtime); err != nil {
+		t.Fatalf("Failed to set mtime: %v", err)
+	}
+
+	info, err := os.Stat(src)
+	if err != nil {
+		t.Fatalf("Failed to stat: %v", err)
+	}
+	meta := fileMetadata(info)
+
+	// S3 hands metadata keys back in canonical header case
+	returned := make(map[string]*string)
+	for key, value := range meta {
+		returned[http.CanonicalHeaderKey(key)] = value
+	}
+
+	if err := restoreFileMetadata(dst, returned); err != nil {
+		t.Fatalf("restoreFileMetadata failed: %v", err)
+	}
+
+	restored, err := os.Stat(dst)
+	if err != nil {
+		t.Fatalf("Failed to stat: %v", err)
+	}
+	if restored.Mode().Perm() != 0750 {
+		t.Errorf("Expected mode 0750, got %o", restored.Mode().Perm())
+	}
+	if !restored.ModTime().Equal(mtime) {
+		t.Errorf("Expected mtime %v, got %v", mtime, restored.ModTime())
+	}
+}
+
+func TestRestoreFileMetadataIgnoresForeignObjects(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "plain.txt")
+	os.WriteFile(path, []byte("data"), 0640)
+
+	if err := restoreFileMetadata(path, nil); err != nil {
+		t.Fatalf("restoreFileMetadata failed: %v", err)
+	}
+	info, _ := os.Stat(path)
+	if info.Mode().Perm() != 0640 {
+		t.Errorf("Expected mode to be left alone, got %o", info.Mode().Perm())
+	}
+}
+
+func TestRestoreFileMetadataSkipsOwnerWithoutRoot(t *testing.T) {
+	defer func(isRoot func() bool) { runningAsRoot = isRoot }(runningAsRoot)
+	runningAsRoot = func() bool { return false }
+
+	path := filepath.Join(t.TempDir(), "owned.txt")
+	os.WriteFile(path, []byte("data"), 0640)
+
+	// Handing the file to another user would fail for anyone but root
+	meta := map[string]*string{metaUID: aws.String("4242"), metaGID: aws.String("4242")}
+	if err := restoreFileMetadata(path, meta); err != nil {
+		t.Fatalf("restoreFileMetadata failed: %v", err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Failed to stat: %v", err)
+	}
+	if uid, _, ok := fileOwner(info); ok && uid == 4242 {
+		t.Errorf("Expected ownership to be left alone")
+	}
+}
+
+func TestRestoreFileMetadataKeepsSetuidWithOwner(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("No setuid bits on Windows")
+	}
+	defer func(isRoot func() bool) { runningAsRoot = isRoot }(runningAsRoot)
+	runningAsRoot = func() bool { return true }
+
+	dir := t.TempDir()
+	src := filepath.Join(dir, "tool")
+	dst := filepath.Join(dir, "restored")
+	os.WriteFile(src, []byte("#!/bin/sh\n"), 0755)
+	os.WriteFile(dst, []byte("#!/bin/sh\n"), 0644)
+	if err := os.Chmod(src, 0755|os.ModeSetuid|os.ModeSetgid); err != nil {
+		t.Fatalf("Failed to chmod: %v", err)
+	}
+
+	info, err := os.Stat(src)
+	if err != nil {
+		t.Fatalf("Failed to stat: %v", err)
+	}
+	// Restoring the file's own owner is allowed for anyone
+	if err := restoreFileMetadata(dst, fileMetadata(info)); err != nil {
+		t.Fatalf("restoreFileMetadata failed: %v", err)
+	}
+
+	restored, err := os.Stat(dst)
+	if err != nil {
+		t.Fatalf("Failed to stat: %v", err)
+	}
+	if restored.Mode()&(os.ModeSetuid|os.ModeSetgid) != os.ModeSetuid|os.ModeSetgid {
+		t.Errorf("Expected setuid and setgid to survive, got %v", restored.Mode())
+	}
+}
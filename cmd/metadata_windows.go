@@ -0,0 +1,15 @@
+//go:build windows
+
+package cmd
+
+import "os"
+
+// fileOwner reports no owner on Windows, which has no uid/gid.
+func fileOwner(info os.FileInfo) (uid, gid int, ok bool) {
+	return 0, 0, false
+}
+
+// chownFile is a no-op on Windows; recorded ownership cannot be applied.
+func chownFile(path string, uid, gid int) error {
+	return nil
+}
@@ -0,0 +1,311 @@
+package cmd
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// safeLocalPath maps an object key to a path under root, rejecting keys that
+// would escape it: absolute keys, drive or UNC prefixes, ".." segments that
+// climb above root, and paths whose existing parent directories are symlinks
+// leading outside root.
+func safeLocalPath(root, key string) (string, error) {
+	rel := filepath.FromSlash(strings.TrimSuffix(key, "/"))
+	if strings.ContainsRune(key, 0) || !filepath.IsLocal(rel) {
+		return "", fmt.Errorf("refusing to download %q: key escapes the output directory", key)
+	}
+	localPath := filepath.Join(root, rel)
+
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", err
+	}
+
+	// Resolve the deepest parent that already exists; anything below it will
+	// be created as a real directory.
+	parent := filepath.Dir(localPath)
+	for parent != filepath.Clean(root) {
+		if _, err := os.Lstat(parent); err == nil {
+			break
+		}
+		parent = filepath.Dir(parent)
+	}
+
+	realParent, err := filepath.EvalSymlinks(parent)
+	if err != nil {
+		return "", fmt.Errorf("refusing to download %q: %v", key, err)
+	}
+	relParent, err := filepath.Rel(realRoot, realParent)
+	if err != nil || (relParent != "." && !filepath.IsLocal(relParent)) {
+		return "", fmt.Errorf("refusing to download %q: %s is a symlink outside the output directory", key, parent)
+	}
+
+	return localPath, nil
+}
+
+// Policies accepted by --key-conflicts.
+const (
+	conflictSkip   = "skip"
+	conflictRename = "rename"
+	conflictFail   = "fail"
+)
+
+// maxNameBytes is the longest file name most local filesystems accept.
+const maxNameBytes = 255
+
+// conflictSuffix is appended to a file whose key is also used as a directory
+// by other keys, e.g. "a" alongside "a/b".
+const conflictSuffix = ".s3sync-file"
+
+var keyConflictPolicy string
+
+// keyIssue describes an object key that cannot be written to the local
+// filesystem as-is.
+type keyIssue struct {
+	Key       string
+	Reason    string
+	LocalPath string // set when the key was renamed
+}
+
+func (i keyIssue) String() string {
+	if i.LocalPath != "" {
+		return fmt.Sprintf("%s: %s (renamed to %s)", i.Key, i.Reason, i.LocalPath)
+	}
+	return fmt.Sprintf("%s: %s (skipped)", i.Key, i.Reason)
+}
+
+// planLocalPaths decides the local relative path (slash-separated) for each
+// key, after reversing any --escape-keys escaping, before anything is
+// downloaded. A key that an existing local file maps to, as indexed by
+// indexLocalFiles, keeps using that file even if the names differ, e.g. in
+// Unicode normalization form. Of several keys that normalize to the same
+// name only one is downloaded, preferring the one already normalized. Keys
+// with empty segments ("a//b", "/a"), names over 255 bytes, characters the
+// local filesystem cannot store, or that would need to be both a file and a
+// directory are handled by --key-conflicts: skipped, renamed with escaping,
+// or failing the run.
+func planLocalPaths(keys []string, existing map[string]localEntry) (map[string]string, []keyIssue, error) {
+	switch keyConflictPolicy {
+	case conflictSkip, conflictRename, conflictFail:
+	default:
+		return nil, nil, fmt.Errorf("invalid --key-conflicts value %q (want skip, rename or fail)", keyConflictPolicy)
+	}
+
+	sorted := append([]string(nil), keys...)
+	sort.Strings(sorted)
+
+	plan := make(map[string]string, len(sorted))
+	var issues []keyIssue
+
+	// report records a problem with key, merging it with an earlier one
+	report := func(key, reason, localPath string) {
+		for i := range issues {
+			if issues[i].Key == key {
+				issues[i].Reason += ", " + reason
+				issues[i].LocalPath = localPath
+				return
+			}
+		}
+		issues = append(issues, keyIssue{Key: key, Reason: reason, LocalPath: localPath})
+	}
+
+	kept := make(map[string]string)
+	for _, key := range sorted {
+		normalized := normalizeKey(key)
+		if other, ok := kept[normalized]; !ok || (key == normalized && other != normalized) {
+			kept[normalized] = key
+		}
+	}
+
+	renamed := make(map[string]bool)
+	for _, key := range sorted {
+		normalized := normalizeKey(key)
+		if kept[normalized] != key {
+			report(key, "same name as "+kept[normalized]+" after key normalization", "")
+			continue
+		}
+		if local, ok := existing[normalized]; ok {
+			plan[key] = filepath.ToSlash(local.Path)
+			continue
+		}
+
+		localPath, reason := representableKey(localName(key))
+		if reason == "" {
+			plan[key] = localPath
+			continue
+		}
+		if keyConflictPolicy == conflictRename {
+			plan[key] = localPath
+			renamed[key] = true
+			report(key, reason, localPath)
+		} else {
+			report(key, reason, "")
+		}
+	}
+
+	// Every parent of a planned path has to be a directory, and so does the
+	// path of a directory marker.
+	dirs := make(map[string]bool)
+	for _, localPath := range plan {
+		parts := strings.Split(strings.TrimSuffix(localPath, "/"), "/")
+		for i := 1; i < len(parts); i++ {
+			dirs[strings.Join(parts[:i], "/")] = true
+		}
+		if isDirMarker(localPath) {
+			dirs[strings.TrimSuffix(localPath, "/")] = true
+		}
+	}
+
+	// Keys that kept their own name claim their path before renamed ones
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return !renamed[sorted[i]] && renamed[sorted[j]]
+	})
+
+	used := make(map[string]bool, len(plan))
+	for _, key := range sorted {
+		localPath, ok := plan[key]
+		if !ok {
+			continue
+		}
+
+		if !isDirMarker(localPath) && dirs[localPath] {
+			if keyConflictPolicy != conflictRename {
+				delete(plan, key)
+				report(key, "file conflicts with a directory of the same name", "")
+				continue
+			}
+			localPath += conflictSuffix
+			report(key, "file conflicts with a directory of the same name", localPath)
+		}
+
+		// Renaming can make two keys land on the same path
+		if used[localPath] {
+			if keyConflictPolicy != conflictRename {
+				delete(plan, key)
+				report(key, "maps to the same local path as another key", "")
+				continue
+			}
+			base := localPath
+			for n := 2; used[localPath]; n++ {
+				localPath = fmt.Sprintf("%s~%d", base, n)
+			}
+			report(key, "maps to the same local path as another key", localPath)
+		}
+
+		used[localPath] = true
+		plan[key] = localPath
+	}
+
+	if keyConflictPolicy == conflictFail && len(issues) > 0 {
+		var lines []string
+		for _, issue := range issues {
+			lines = append(lines, issue.Key+": "+issue.Reason)
+		}
+		return nil, issues, fmt.Errorf("%d key(s) cannot be stored locally:\n  %s", len(issues), strings.Join(lines, "\n  "))
+	}
+
+	return plan, issues, nil
+}
+
+// representableKey checks each segment of key and returns a rewritten path
+// along with the reason when the key cannot be used as a local path as-is.
+func representableKey(key string) (string, string) {
+	var emptySegment, invalidChars, tooLong bool
+	var fixed []string
+	for _, segment := range strings.Split(strings.TrimSuffix(key, "/"), "/") {
+		if segment == "" {
+			emptySegment = true
+			continue
+		}
+		if !validLocalName(segment) {
+			invalidChars = true
+			segment = escapeLocalName(segment)
+		}
+		if len(segment) > maxNameBytes {
+			tooLong = true
+			segment = shortenName(segment)
+		}
+		fixed = append(fixed, segment)
+	}
+
+	var reasons []string
+	if emptySegment {
+		reasons = append(reasons, "empty path segment")
+	}
+	if invalidChars {
+		reasons = append(reasons, "unrepresentable characters")
+	}
+	if tooLong {
+		reasons = append(reasons, "name longer than 255 bytes")
+	}
+	if len(reasons) == 0 {
+		return key, ""
+	}
+
+	if len(fixed) == 0 {
+		fixed = []string{"%2F"}
+	}
+	localPath := strings.Join(fixed, "/")
+	if isDirMarker(key) {
+		localPath += "/"
+	}
+	return localPath, strings.Join(reasons, ", ")
+}
+
+// validLocalName reports whether name can be created as-is on this platform.
+// Linux stores arbitrary bytes, but Windows and macOS require valid Unicode.
+func validLocalName(name string) bool {
+	if runtime.GOOS != "linux" && !utf8.ValidString(name) {
+		return false
+	}
+	for _, r := range name {
+		if r < 0x20 || r == 0x7f || (runtime.GOOS == "windows" && strings.ContainsRune(`<>:"|?*\`, r)) {
+			return false
+		}
+	}
+	return true
+}
+
+// escapeLocalName percent-escapes the bytes of name that cannot appear in a
+// local file name, along with "%" itself so that the result is unambiguous.
+func escapeLocalName(name string) string {
+	var b strings.Builder
+	for len(name) > 0 {
+		r, size := utf8.DecodeRuneInString(name)
+		if r == '%' || (r == utf8.RuneError && size <= 1) || !validLocalName(name[:size]) {
+			for _, c := range []byte(name[:size]) {
+				fmt.Fprintf(&b, "%%%02X", c)
+			}
+		} else {
+			b.WriteString(name[:size])
+		}
+		name = name[size:]
+	}
+	return b.String()
+}
+
+// shortenName truncates name to fit maxNameBytes, keeping it unique with a
+// hash of the full name and preserving a short extension.
+func shortenName(name string) string {
+	sum := sha1.Sum([]byte(name))
+	suffix := "~" + hex.EncodeToString(sum[:4])
+	ext := path.Ext(name)
+	if len(ext) > 16 {
+		ext = ""
+	}
+
+	keep := maxNameBytes - len(suffix) - len(ext)
+	stem := name[:len(name)-len(ext)]
+	for keep > 0 && !utf8.RuneStart(stem[keep]) {
+		keep--
+	}
+	return stem[:keep] + suffix + ext
+}
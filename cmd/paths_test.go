@@ -0,0 +1,168 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSafeLocalPath(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	os.Mkdir(filepath.Join(root, "real"), 0755)
+	if err := os.Symlink(outside, filepath.Join(root, "escape")); err != nil {
+		t.Skipf("Symlinks not supported: %v", err)
+	}
+	os.Symlink("real", filepath.Join(root, "inside"))
+
+	allowed := []string{
+		"index.json",
+		"mvs/indexmvs.json",
+		"a/../b.txt",
+		"real/new/deep/file.txt",
+		"inside/file.txt",
+		"dir/",
+	}
+	for _, key := range allowed {
+		if _, err := safeLocalPath(root, key); err != nil {
+			t.Errorf("Expected %q to be allowed, got %v", key, err)
+		}
+	}
+
+	rejected := []string{
+		"../../home/user/.bashrc",
+		"a/../../b.txt",
+		"/etc/passwd",
+		"",
+		"escape/file.txt",
+		"escape/sub/dir/file.txt",
+	}
+	for _, key := range rejected {
+		if path, err := safeLocalPath(root, key); err == nil {
+			t.Errorf("Expected %q to be rejected, got %s", key, path)
+		}
+	}
+}
+
+func planWithPolicy(t *testing.T, policy string, keys ...string) (map[string]string, []keyIssue, error) {
+	keyConflictPolicy = policy
+	defer func() { keyConflictPolicy = conflictSkip }()
+	return planLocalPaths(keys, nil)
+}
+
+func TestPlanLocalPathsSkip(t *testing.T) {
+	longName := strings.Repeat("x", 300) + ".json"
+	plan, issues, err := planWithPolicy(t, conflictSkip,
+		"a", "a/b", "c", "c/", "ok.txt", "dir/", "dir/file", "x//y", longName, "bad\x01name")
+	if err != nil {
+		t.Fatalf("planLocalPaths failed: %v", err)
+	}
+
+	for _, key := range []string{"a/b", "c/", "ok.txt", "dir/", "dir/file"} {
+		if plan[key] != key {
+			t.Errorf("Expected %q to map to itself, got %q", key, plan[key])
+		}
+	}
+	for _, key := range []string{"a", "c", "x//y", longName, "bad\x01name"} {
+		if _, ok := plan[key]; ok {
+			t.Errorf("Expected %q to be skipped", key)
+		}
+	}
+	if len(issues) != 5 {
+		t.Errorf("Expected 5 issues, got %v", issues)
+	}
+}
+
+func TestPlanLocalPathsRename(t *testing.T) {
+	longName := strings.Repeat("é", 150) + ".json"
+	plan, issues, err := planWithPolicy(t, conflictRename,
+		"a", "a/b", "c", "c/", "x//y", "x/y", longName, "bad\x01name%")
+	if err != nil {
+		t.Fatalf("planLocalPaths failed: %v", err)
+	}
+
+	expected := map[string]string{
+		"a":            "a" + conflictSuffix,
+		"a/b":          "a/b",
+		"c":            "c" + conflictSuffix,
+		"c/":           "c/",
+		"x/y":          "x/y",
+		"x//y":         "x/y~2",
+		"bad\x01name%": "bad%01name%25",
+	}
+	for key, want := range expected {
+		if plan[key] != want {
+			t.Errorf("Expected %q to map to %q, got %q", key, want, plan[key])
+		}
+	}
+
+	short := plan[longName]
+	if len(short) > maxNameBytes || !strings.HasSuffix(short, ".json") || !utf8.ValidString(short) {
+		t.Errorf("Expected a valid shortened name ending in .json, got %q (%d bytes)", short, len(short))
+	}
+	if len(issues) != 5 {
+		t.Errorf("Expected 5 renames, got %v", issues)
+	}
+}
+
+func TestPlanLocalPathsFail(t *testing.T) {
+	if _, _, err := planWithPolicy(t, conflictFail, "a", "a/b"); err == nil {
+		t.Fatal("Expected the fail policy to return an error")
+	}
+	if _, _, err := planWithPolicy(t, conflictFail, "a/b", "c"); err != nil {
+		t.Fatalf("Expected clean keys to pass, got %v", err)
+	}
+}
+
+func TestPlanLocalPathsNormalizedDuplicates(t *testing.T) {
+	nfc, nfd := "Caf\u00e9.txt", "Cafe\u0301.txt"
+	existing := map[string]localEntry{
+		"menu/" + nfc: {Path: filepath.Join("menu", nfd)},
+		"taken.txt":   {Path: "other.txt"},
+	}
+
+	// Only one key of each group is kept, and existing files are reused
+	plan, issues, err := planLocalPaths([]string{nfd, nfc, "menu/" + nfd, "taken.txt", "other.txt"}, existing)
+	if err != nil {
+		t.Fatalf("planLocalPaths failed: %v", err)
+	}
+	if plan[nfc] != nfc || plan["menu/"+nfd] != "menu/"+nfd {
+		t.Errorf("Unexpected plan %q", plan)
+	}
+	if _, ok := plan[nfd]; ok {
+		t.Errorf("Expected the NFD duplicate to be skipped")
+	}
+
+	// A reused file that another key maps to as well is still a clash
+	if (plan["taken.txt"] == "other.txt") == (plan["other.txt"] == "other.txt") {
+		t.Errorf("Expected exactly one key at other.txt, got %q", plan)
+	}
+	if len(issues) != 2 {
+		t.Errorf("Expected 2 issues, got %v", issues)
+	}
+}
+
+func TestDownloadRenamedKeyIsUnchanged(t *testing.T) {
+	defer func() { keyConflictPolicy, backupDir = conflictSkip, "" }()
+
+	store := &fakeObjectStore{objects: map[string]string{"a": "file", "a/b": "nested"}}
+	useFakeEndpoint(t, store)
+
+	dir := t.TempDir()
+	keyConflictPolicy, backupDir = conflictRename, t.TempDir()
+	for run := 0; run < 2; run++ {
+		if err := downloadToLocal("bucket", dir); err != nil {
+			t.Fatalf("downloadToLocal failed: %v", err)
+		}
+	}
+
+	if data, err := os.ReadFile(filepath.Join(dir, "a"+conflictSuffix)); err != nil || string(data) != "file" {
+		t.Errorf("Expected a to be stored renamed: %q, %v", data, err)
+	}
+	// Nothing was replaced by the second run
+	if backups, _ := os.ReadDir(backupDir); len(backups) != 0 {
+		t.Errorf("Expected the renamed file to be left alone, got backups %v", backups)
+	}
+}
@@ -0,0 +1,56 @@
+package cmd
+
+import (
+	"path"
+	"regexp"
+	"strings"
+)
+
+// globPattern matches slash-separated object keys. "*" and "?" do not cross
+// "/", "**" matches any number of path segments, and a pattern without a "/"
+// is matched against the base name only, so "*.log" applies at any depth.
+type globPattern struct {
+	raw      string
+	baseName bool
+	re       *regexp.Regexp
+}
+
+func compileGlob(pattern string) (*globPattern, error) {
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch {
+		case c == '*' && strings.HasPrefix(pattern[i:], "**/"):
+			b.WriteString("(?:.*/)?")
+			i += 2
+		case c == '*' && strings.HasPrefix(pattern[i:], "**"):
+			b.WriteString(".*")
+			i++
+		case c == '*':
+			b.WriteString("[^/]*")
+		case c == '?':
+			b.WriteString("[^/]")
+		default:
+			b.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		}
+	}
+	b.WriteString("$")
+
+	re, err := regexp.Compile(b.String())
+	if err != nil {
+		return nil, err
+	}
+	return &globPattern{
+		raw:      pattern,
+		baseName: !strings.Contains(pattern, "/"),
+		re:       re,
+	}, nil
+}
+
+func (g *globPattern) match(key string) bool {
+	if g.baseName {
+		return g.re.MatchString(path.Base(key))
+	}
+	return g.re.MatchString(key)
+}
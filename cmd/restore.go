@@ -0,0 +1,174 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+var (
+	restoreArchived bool
+	restoreTier     string
+	restoreDays     int64
+)
+
+// restoreStateFile keeps track of restores requested by earlier download runs.
+// It lives in the output directory under the same prefix that is excluded
+// from listings, and is never synced itself.
+var restoreStateFile = filepath.Join(strings.TrimSuffix(internalPrefix, "/"), "restores.json")
+
+type restoreState struct {
+	Pending map[string]pendingRestore `json:"pending"`
+
+	path  string
+	dirty bool
+}
+
+type pendingRestore struct {
+	Tier        string    `json:"tier"`
+	RequestedAt time.Time `json:"requestedAt"`
+}
+
+func validateRestoreOptions() error {
+	switch restoreTier {
+	case s3.TierStandard, s3.TierBulk, s3.TierExpedited:
+	default:
+		return fmt.Errorf("invalid --restore-tier %q (want Standard, Bulk or Expedited)", restoreTier)
+	}
+	if restoreDays < 1 {
+		return fmt.Errorf("--restore-days must be at least 1")
+	}
+	return nil
+}
+
+func loadRestoreState(localDir string) (*restoreState, error) {
+	state := &restoreState{
+		Pending: make(map[string]pendingRestore),
+		path:    filepath.Join(localDir, restoreStateFile),
+	}
+	data, err := os.ReadFile(state.path)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("invalid restore state %s: %v", state.path, err)
+	}
+	if state.Pending == nil {
+		state.Pending = make(map[string]pendingRestore)
+	}
+	return state, nil
+}
+
+func (s *restoreState) add(key string, pending pendingRestore) {
+	s.Pending[key] = pending
+	s.dirty = true
+}
+
+func (s *restoreState) remove(key string) {
+	if _, ok := s.Pending[key]; ok {
+		delete(s.Pending, key)
+		s.dirty = true
+	}
+}
+
+// save writes the state back if it changed, removing the file once nothing is
+// pending.
+func (s *restoreState) save() error {
+	if !s.dirty {
+		return nil
+	}
+	if len(s.Pending) == 0 {
+		err := os.Remove(s.path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		os.Remove(filepath.Dir(s.path))
+		return nil
+	}
+
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), os.ModePerm); err != nil {
+		return err
+	}
+	return os.WriteFile(s.path, data, 0644)
+}
+
+// restoreStatus interprets the x-amz-restore header of an archived object.
+func restoreStatus(head *s3.HeadObjectOutput) (requested, ready bool) {
+	if head.Restore == nil {
+		return false, false
+	}
+	return true, strings.Contains(*head.Restore, `ongoing-request="false"`)
+}
+
+// prepareArchived reports whether an object in an archive storage class can
+// be downloaded now. Otherwise it requests a restore with --restore, records
+// it in state, and returns false so the object is skipped for this run.
+func prepareArchived(s3Client *s3.S3, bucketName, key, class string, state *restoreState) (bool, error) {
+	input := &s3.HeadObjectInput{
+		Bucket:    aws.String(bucketName),
+		Key:       aws.String(remoteKey(key)),
+		VersionId: objectVersion(key),
+	}
+	head, err := headObject(s3Client, input)
+	if err != nil {
+		return false, fmt.Errorf("failed to check restore status of %s: %v", key, err)
+	}
+
+	requested, ready := restoreStatus(head)
+	switch {
+	case ready:
+		return true, nil
+	case requested:
+		if _, ok := state.Pending[key]; !ok {
+			state.add(key, pendingRestore{RequestedAt: time.Now().UTC()})
+		}
+		fmt.Printf("Skipped (restore in progress): %s\n", key)
+		return false, nil
+	case !restoreArchived:
+		fmt.Printf("Skipped (archived in %s, use --restore): %s\n", class, key)
+		return false, nil
+	}
+
+	_, err = s3Client.RestoreObject(&s3.RestoreObjectInput{
+		Bucket:    aws.String(bucketName),
+		Key:       aws.String(remoteKey(key)),
+		VersionId: objectVersion(key),
+		RestoreRequest: &s3.RestoreRequest{
+			Days: aws.Int64(restoreDays),
+			GlacierJobParameters: &s3.GlacierJobParameters{
+				Tier: aws.String(restoreTier),
+			},
+		},
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "RestoreAlreadyInProgress" {
+		err = nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to request restore of %s: %v", key, err)
+	}
+
+	state.add(key, pendingRestore{Tier: restoreTier, RequestedAt: time.Now().UTC()})
+	fmt.Printf("Requested %s restore: %s\n", restoreTier, key)
+	return false, nil
+}
+
+// isArchivedError reports whether a GetObject failed because the object has
+// to be restored first, e.g. in an Intelligent-Tiering archive tier.
+func isArchivedError(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	return ok && aerr.Code() == "InvalidObjectState"
+}
@@ -0,0 +1,99 @@
+package cmd
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPrepareArchived(t *testing.T) {
+	defer func() { restoreArchived = false }()
+
+	restoreHeader := map[string]string{
+		"/bucket/ready.bin":   `ongoing-request="false", expiry-date="Fri, 21 Dec 2030 00:00:00 GMT"`,
+		"/bucket/ongoing.bin": `ongoing-request="true"`,
+	}
+	var restoreBody string
+	client := newFakeS3Client(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodHead:
+			if value, ok := restoreHeader[r.URL.Path]; ok {
+				w.Header().Set("X-Amz-Restore", value)
+			}
+		case http.MethodPost:
+			if _, ok := r.URL.Query()["restore"]; !ok || r.URL.Path != "/bucket/cold.bin" {
+				t.Errorf("Unexpected request %s %s", r.Method, r.URL)
+			}
+			body, _ := io.ReadAll(r.Body)
+			restoreBody = string(body)
+			w.WriteHeader(http.StatusAccepted)
+		default:
+			t.Errorf("Unexpected request %s %s", r.Method, r.URL)
+		}
+	})
+
+	state, err := loadRestoreState(t.TempDir())
+	if err != nil {
+		t.Fatalf("loadRestoreState failed: %v", err)
+	}
+
+	if ready, err := prepareArchived(client, "bucket", "ready.bin", "GLACIER", state); err != nil || !ready {
+		t.Errorf("Expected a restored object to be ready: %v, %v", ready, err)
+	}
+	if ready, err := prepareArchived(client, "bucket", "ongoing.bin", "GLACIER", state); err != nil || ready {
+		t.Errorf("Expected an ongoing restore to be skipped: %v, %v", ready, err)
+	}
+	if ready, err := prepareArchived(client, "bucket", "cold.bin", "DEEP_ARCHIVE", state); err != nil || ready || restoreBody != "" {
+		t.Errorf("Expected no restore request without --restore: %v, %v", ready, err)
+	}
+
+	restoreArchived, restoreTier, restoreDays = true, "Bulk", 3
+	if ready, err := prepareArchived(client, "bucket", "cold.bin", "DEEP_ARCHIVE", state); err != nil || ready {
+		t.Errorf("Expected a requested restore to be skipped: %v, %v", ready, err)
+	}
+	if !strings.Contains(restoreBody, "<Days>3</Days>") || !strings.Contains(restoreBody, "<Tier>Bulk</Tier>") {
+		t.Errorf("Unexpected restore request: %s", restoreBody)
+	}
+	if state.Pending["cold.bin"].Tier != "Bulk" {
+		t.Errorf("Expected the restore to be recorded, got %v", state.Pending)
+	}
+	if _, ok := state.Pending["ongoing.bin"]; !ok {
+		t.Errorf("Expected the ongoing restore to be recorded, got %v", state.Pending)
+	}
+}
+
+func TestRestoreStatePersistence(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "file.txt"), []byte("data"), 0644)
+
+	state, _ := loadRestoreState(dir)
+	state.add("cold.bin", pendingRestore{Tier: "Standard"})
+	if err := state.save(); err != nil {
+		t.Fatalf("save failed: %v", err)
+	}
+
+	state, err := loadRestoreState(dir)
+	if err != nil || state.Pending["cold.bin"].Tier != "Standard" {
+		t.Fatalf("Expected the pending restore to be reloaded: %v, %v", state.Pending, err)
+	}
+
+	// The state directory is never treated as a local file
+	files, err := scanLocalFiles(dir)
+	if err != nil {
+		t.Fatalf("scanLocalFiles failed: %v", err)
+	}
+	if len(files) != 1 {
+		t.Errorf("Expected only file.txt to be scanned, got %v", files)
+	}
+
+	state.remove("cold.bin")
+	if err := state.save(); err != nil {
+		t.Fatalf("save failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, ".s3sync")); !os.IsNotExist(err) {
+		t.Errorf("Expected the state directory to be removed once empty")
+	}
+}
@@ -0,0 +1,268 @@
+package cmd
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/spf13/cobra"
+)
+
+var (
+	rollbackTo     string
+	rollbackRun    string
+	rollbackPrefix string
+	rollbackApply  bool
+)
+
+var rollbackCmd = &cobra.Command{
+	Use:     "rollback",
+	Short:   "Restore a bucket prefix to an earlier state using object versions",
+	PreRunE: requireFlags("bucket"),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return rollbackBucket(bucketName, rollbackPrefix)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(rollbackCmd)
+	rollbackCmd.Flags().StringVar(&rollbackTo, "to", "", "Point in time to roll back to (RFC 3339, date, or duration ago)")
+	rollbackCmd.Flags().StringVar(&rollbackRun, "run", "", "ID of a recorded run to undo, restoring the keys it changed to their state from just before it")
+	rollbackCmd.Flags().StringVar(&rollbackPrefix, "prefix", "", "Only roll back keys under this prefix")
+	rollbackCmd.Flags().BoolVar(&rollbackApply, "apply", false, "Apply the plan; without it the plan is only printed")
+}
+
+// rollbackStep restores key to an earlier version.
+type rollbackStep struct {
+	Key       string
+	VersionID string
+	Class     string
+}
+
+type rollbackPlan struct {
+	Restore []rollbackStep
+	Delete  []string
+}
+
+// planRollback compares the versions current now with those current at the
+// target time. Keys whose version differs are restored and keys that did not
+// exist then are deleted.
+func planRollback(targetVersions, targetClasses, currentVersions map[string]string) rollbackPlan {
+	var plan rollbackPlan
+	for key, version := range targetVersions {
+		if currentVersions[key] != version {
+			plan.Restore = append(plan.Restore, rollbackStep{Key: key, VersionID: version, Class: targetClasses[key]})
+		}
+	}
+	for key := range currentVersions {
+		if _, ok := targetVersions[key]; !ok {
+			plan.Delete = append(plan.Delete, key)
+		}
+	}
+	sort.Slice(plan.Restore, func(i, j int) bool { return plan.Restore[i].Key < plan.Restore[j].Key })
+	sort.Strings(plan.Delete)
+	return plan
+}
+
+func rollbackBucket(bucketName, prefix string) error {
+	startedAt := time.Now()
+
+	if (rollbackTo == "") == (rollbackRun == "") {
+		return fmt.Errorf("exactly one of --to and --run is required")
+	}
+
+	if err := loadSSEConfig(); err != nil {
+		return err
+	}
+
+	if err := loadEncryptionConfig(); err != nil {
+		return err
+	}
+
+	sess, err := newSession()
+	if err != nil {
+		return err
+	}
+
+	s3Client := s3.New(sess)
+
+	versioned, err := bucketVersioned(s3Client, bucketName)
+	if err != nil {
+		return fmt.Errorf("failed to access bucket: %v", err)
+	}
+	if !versioned {
+		return fmt.Errorf("bucket %s does not have versioning enabled, so there is nothing to roll back to", bucketName)
+	}
+
+	// With --run only the keys the run changed are rolled back, so that
+	// unrelated changes made since are kept
+	var asOf time.Time
+	var touched map[string]bool
+	if rollbackRun != "" {
+		run, err := loadRunRecord(s3Client, bucketName, rollbackRun)
+		if err != nil {
+			return err
+		}
+		// LastModified has one-second resolution, so anything written in
+		// the second the run started counts as part of the run
+		asOf = run.StartedAt.Truncate(time.Second).Add(-time.Nanosecond)
+		fmt.Printf("Rolling back the keys changed by run %s (started %s)\n", run.RunID, run.StartedAt.Format(time.RFC3339))
+
+		touched = make(map[string]bool)
+		for _, keys := range [][]string{run.Uploaded, run.Deleted} {
+			for _, stored := range keys {
+				if key, ok := listedKey(stored); ok {
+					touched[key] = true
+				}
+			}
+		}
+
+		later, err := laterRuns(s3Client, bucketName, run)
+		if err != nil {
+			return err
+		}
+		if len(later) > 0 {
+			fmt.Printf("Warning: later run(s) changed some of the same keys, and their changes to them are rolled back too: %s\n", strings.Join(later, ", "))
+		}
+	} else {
+		if asOf, err = parseAsOf(rollbackTo, startedAt); err != nil {
+			return err
+		}
+		fmt.Printf("Rolling back to the state at %s\n", asOf.Format(time.RFC3339))
+	}
+
+	_, targetClasses, targetVersions, err := listVersionsAsOf(s3Client, bucketName, prefix, asOf)
+	if err != nil {
+		return err
+	}
+	_, _, currentVersions, err := listVersionsAsOf(s3Client, bucketName, prefix, time.Time{})
+	if err != nil {
+		return err
+	}
+
+	if touched != nil {
+		for _, versions := range []map[string]string{targetVersions, currentVersions} {
+			for key := range versions {
+				if !touched[key] {
+					delete(versions, key)
+				}
+			}
+		}
+	}
+
+	plan := planRollback(targetVersions, targetClasses, currentVersions)
+	if len(plan.Restore) == 0 && len(plan.Delete) == 0 {
+		fmt.Println("Nothing to roll back")
+		return nil
+	}
+
+	for _, step := range plan.Restore {
+		fmt.Printf("  restore %s (version %s)\n", step.Key, step.VersionID)
+	}
+	for _, key := range plan.Delete {
+		fmt.Printf("  delete  %s\n", key)
+	}
+	fmt.Printf("Plan: %d to restore, %d to delete\n", len(plan.Restore), len(plan.Delete))
+
+	if !rollbackApply {
+		fmt.Println("Dry run: pass --apply to roll back")
+		return nil
+	}
+
+	event := &syncEvent{
+		RunID:     newRunID(startedAt),
+		Operation: "rollback",
+		Bucket:    bucketName,
+		Prefix:    prefix,
+		Uploaded:  []string{},
+		Deleted:   []string{},
+		StartedAt: startedAt,
+	}
+
+	var failed []string
+	for _, step := range plan.Restore {
+		if isArchived(step.Class) {
+			fmt.Printf("Error: version %s of %s is archived in %s and must be restored first\n", step.VersionID, step.Key, step.Class)
+			failed = append(failed, step.Key)
+			continue
+		}
+		if err := copyVersion(s3Client, bucketName, step); err != nil {
+			return fmt.Errorf("failed to restore %s: %v", step.Key, err)
+		}
+		fmt.Printf("Restored s3://%s/%s to version %s\n", bucketName, step.Key, step.VersionID)
+		event.Uploaded = append(event.Uploaded, remoteKey(step.Key))
+	}
+
+	// Deleting only adds a delete marker, so this can be rolled back as well
+	for _, key := range plan.Delete {
+		_, err := s3Client.DeleteObject(&s3.DeleteObjectInput{
+			Bucket: aws.String(bucketName),
+			Key:    aws.String(remoteKey(key)),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to delete object %s: %v", key, err)
+		}
+		fmt.Printf("Deleted s3://%s/%s\n", bucketName, key)
+		event.Deleted = append(event.Deleted, remoteKey(key))
+	}
+
+	event.Totals.Uploaded = len(event.Uploaded)
+	event.Totals.Deleted = len(event.Deleted)
+	event.FinishedAt = time.Now()
+	if err := recordRun(s3Client, bucketName, event); err != nil {
+		fmt.Printf("Warning: failed to record run %s: %v\n", event.RunID, err)
+	} else {
+		fmt.Printf("Run ID: %s\n", event.RunID)
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("%d key(s) could not be rolled back", len(failed))
+	}
+	return nil
+}
+
+// copyVersion makes an earlier version of a key its current version again.
+func copyVersion(s3Client *s3.S3, bucketName string, step rollbackStep) error {
+	stored := remoteKey(step.Key)
+	return copyObject(s3Client, bucketName, stored, aws.String(step.VersionID), stored, step.Class)
+}
+
+// copyObject copies an object, or one of its versions, to another key. The
+// copy keeps the metadata, tags, encryption and ACL of the source, and gets
+// the given storage class, or STANDARD if there is none. Options such as
+// --sse and --acl only apply to uploads and are not used here.
+func copyObject(s3Client *s3.S3, bucketName, from string, version *string, to, class string) error {
+	head := &s3.HeadObjectInput{
+		Bucket:    aws.String(bucketName),
+		Key:       aws.String(from),
+		VersionId: version,
+	}
+	source, err := headObject(s3Client, head)
+	if err != nil {
+		return err
+	}
+
+	copySource := bucketName + "/" + escapeCopyKey(from)
+	if version != nil {
+		copySource += "?versionId=" + url.QueryEscape(*version)
+	}
+	input := &s3.CopyObjectInput{
+		Bucket:            aws.String(bucketName),
+		Key:               aws.String(to),
+		CopySource:        aws.String(copySource),
+		MetadataDirective: aws.String(s3.MetadataDirectiveCopy),
+	}
+	if class != "" {
+		input.StorageClass = aws.String(class)
+	}
+	applySourceSSE(input, source)
+
+	if _, err := s3Client.CopyObject(input); err != nil {
+		return err
+	}
+	return copyObjectACL(s3Client, bucketName, from, version, to)
+}
@@ -0,0 +1,188 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPlanRollback(t *testing.T) {
+	target := map[string]string{"same.txt": "s1", "changed.txt": "c1", "deleted.txt": "d1"}
+	classes := map[string]string{"same.txt": "STANDARD", "changed.txt": "STANDARD_IA", "deleted.txt": "STANDARD"}
+	current := map[string]string{"same.txt": "s1", "changed.txt": "c2", "added.txt": "a1"}
+
+	plan := planRollback(target, classes, current)
+	wantRestore := []rollbackStep{
+		{Key: "changed.txt", VersionID: "c1", Class: "STANDARD_IA"},
+		{Key: "deleted.txt", VersionID: "d1", Class: "STANDARD"},
+	}
+	if !reflect.DeepEqual(plan.Restore, wantRestore) {
+		t.Errorf("Unexpected restores %v", plan.Restore)
+	}
+	if !reflect.DeepEqual(plan.Delete, []string{"added.txt"}) {
+		t.Errorf("Unexpected deletes %v", plan.Delete)
+	}
+}
+
+// fakeVersionedBucket serves just enough of the S3 API for rollbackBucket
+// and records the writes it receives. Keys in kmsKeys are encrypted with
+// that KMS key, and keys in public are readable by everyone.
+type fakeVersionedBucket struct {
+	mu       sync.Mutex
+	versions string
+	runs     map[string][]byte
+	kmsKeys  map[string]string
+	public   map[string]bool
+	writes   []string
+}
+
+func (b *fakeVersionedBucket) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	query := r.URL.Query()
+	key := strings.TrimPrefix(r.URL.Path, "/bucket/")
+	switch {
+	case r.Method == http.MethodHead:
+		if kmsKey, ok := b.kmsKeys[key]; ok {
+			w.Header().Set("X-Amz-Server-Side-Encryption", "aws:kms")
+			w.Header().Set("X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id", kmsKey)
+		}
+	case r.Method == http.MethodGet && query.Has("acl"):
+		grants := `<Grant><Grantee xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance" xsi:type="CanonicalUser"><ID>owner</ID></Grantee><Permission>FULL_CONTROL</Permission></Grant>`
+		if b.public[key] {
+			grants += `<Grant><Grantee xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance" xsi:type="Group"><URI>http://acs.amazonaws.com/groups/global/AllUsers</URI></Grantee><Permission>READ</Permission></Grant>`
+		}
+		w.Write([]byte(`<AccessControlPolicy><Owner><ID>owner</ID></Owner><AccessControlList>` + grants + `</AccessControlList></AccessControlPolicy>`))
+	case r.Method == http.MethodPut && query.Has("acl"):
+		b.writes = append(b.writes, "acl "+key)
+	case r.Method == http.MethodGet && query.Has("versioning"):
+		w.Write([]byte(`<VersioningConfiguration><Status>Enabled</Status></VersioningConfiguration>`))
+	case r.Method == http.MethodGet && query.Get("list-type") == "2":
+		var body strings.Builder
+		body.WriteString(`<ListBucketResult><IsTruncated>false</IsTruncated>`)
+		for key := range b.runs {
+			fmt.Fprintf(&body, `<Contents><Key>%s</Key><LastModified>2024-03-09T12:00:10Z</LastModified></Contents>`, key)
+		}
+		body.WriteString(`</ListBucketResult>`)
+		w.Write([]byte(body.String()))
+	case r.Method == http.MethodGet && query.Has("versions"):
+		w.Write([]byte(`<ListVersionsResult><IsTruncated>false</IsTruncated>` + b.versions + `</ListVersionsResult>`))
+	case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/bucket/.s3sync/runs/"):
+		body, ok := b.runs[strings.TrimPrefix(r.URL.Path, "/bucket/")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`<Error><Code>NoSuchKey</Code></Error>`))
+			return
+		}
+		w.Write(body)
+	case r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source") != "":
+		write := "copy " + r.Header.Get("X-Amz-Copy-Source")
+		if sse := r.Header.Get("X-Amz-Server-Side-Encryption"); sse != "" {
+			write += " " + sse + " " + r.Header.Get("X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id")
+		}
+		b.writes = append(b.writes, write)
+		w.Write([]byte(`<CopyObjectResult><ETag>"x"</ETag></CopyObjectResult>`))
+	case r.Method == http.MethodPut && strings.HasPrefix(r.URL.Path, "/bucket/.s3sync/runs/"):
+		b.writes = append(b.writes, "record")
+	case r.Method == http.MethodDelete:
+		b.writes = append(b.writes, "delete "+strings.TrimPrefix(r.URL.Path, "/bucket/"))
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "unexpected request "+r.Method+" "+r.URL.String(), http.StatusBadRequest)
+	}
+}
+
+func useFakeEndpoint(t *testing.T, handler http.Handler) {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	isolateAWSConfig(t)
+
+	endpointURL, region = server.URL, "us-east-1"
+	accessKeyID, secretAccessKey = "test", "test"
+}
+
+func TestRollbackBucket(t *testing.T) {
+	defer func() { rollbackTo, rollbackRun, rollbackApply = "", "", false }()
+
+	run, _ := json.Marshal(syncEvent{
+		RunID:     "run-1",
+		Uploaded:  []string{"data/a.txt", "data/new.txt"},
+		Deleted:   []string{"data/b.txt"},
+		StartedAt: time.Date(2024, 3, 9, 12, 0, 0, 500, time.UTC),
+	})
+	laterRun, _ := json.Marshal(syncEvent{
+		RunID:     "run-2",
+		Uploaded:  []string{"data/later.txt"},
+		Deleted:   []string{"data/b.txt"},
+		StartedAt: time.Date(2024, 3, 9, 12, 0, 2, 0, time.UTC),
+	})
+	bucket := &fakeVersionedBucket{
+		runs:    map[string][]byte{".s3sync/runs/run-1.json": run, ".s3sync/runs/run-2.json": laterRun},
+		kmsKeys: map[string]string{"data/a.txt": "key-1"},
+		public:  map[string]bool{"data/a.txt": true},
+		versions: `
+  <Version><Key>data/a.txt</Key><VersionId>a2</VersionId><IsLatest>true</IsLatest><LastModified>2024-03-09T12:00:00Z</LastModified><ETag>"2"</ETag></Version>
+  <Version><Key>data/a.txt</Key><VersionId>a1</VersionId><LastModified>2024-03-01T00:00:00Z</LastModified><ETag>"1"</ETag></Version>
+  <Version><Key>data/b.txt</Key><VersionId>b1</VersionId><LastModified>2024-03-01T00:00:00Z</LastModified><ETag>"1"</ETag></Version>
+  <Version><Key>data/later.txt</Key><VersionId>l1</VersionId><IsLatest>true</IsLatest><LastModified>2024-03-09T12:00:02Z</LastModified><ETag>"1"</ETag></Version>
+  <Version><Key>data/new.txt</Key><VersionId>n1</VersionId><IsLatest>true</IsLatest><LastModified>2024-03-09T12:00:01Z</LastModified><ETag>"1"</ETag></Version>
+  <Version><Key>other/c.txt</Key><VersionId>c2</VersionId><IsLatest>true</IsLatest><LastModified>2024-03-09T12:00:01Z</LastModified><ETag>"2"</ETag></Version>
+  <Version><Key>other/c.txt</Key><VersionId>c1</VersionId><LastModified>2024-03-01T00:00:00Z</LastModified><ETag>"1"</ETag></Version>
+  <DeleteMarker><Key>data/b.txt</Key><VersionId>b2</VersionId><IsLatest>true</IsLatest><LastModified>2024-03-09T12:00:02Z</LastModified></DeleteMarker>`,
+	}
+	useFakeEndpoint(t, bucket)
+
+	// The plan alone changes nothing
+	rollbackRun = "run-1"
+	if err := rollbackBucket("bucket", "data/"); err != nil {
+		t.Fatalf("rollbackBucket failed: %v", err)
+	}
+	if len(bucket.writes) != 0 {
+		t.Fatalf("Expected a dry run, got %v", bucket.writes)
+	}
+
+	// Keys the run did not change are kept, but later changes to the keys
+	// it did change are reported
+	later, err := laterRuns(newFakeS3Client(t, bucket.ServeHTTP), "bucket", &syncEvent{RunID: "run-1", Uploaded: []string{"data/b.txt"}, StartedAt: time.Date(2024, 3, 9, 12, 0, 0, 500, time.UTC)})
+	if err != nil {
+		t.Fatalf("laterRuns failed: %v", err)
+	}
+	if !reflect.DeepEqual(later, []string{"run-2"}) {
+		t.Errorf("Unexpected later runs %v", later)
+	}
+
+	rollbackApply = true
+	if err := rollbackBucket("bucket", "data/"); err != nil {
+		t.Fatalf("rollbackBucket failed: %v", err)
+	}
+	sort.Strings(bucket.writes)
+	// The restored versions keep their encryption and ACL
+	want := []string{
+		"acl data/a.txt",
+		"copy bucket/data/a.txt?versionId=a1 aws:kms key-1",
+		"copy bucket/data/b.txt?versionId=b1",
+		"delete data/new.txt",
+		"record",
+	}
+	if !reflect.DeepEqual(bucket.writes, want) {
+		t.Errorf("Unexpected writes %v, want %v", bucket.writes, want)
+	}
+
+	rollbackRun = "missing"
+	if err := rollbackBucket("bucket", ""); err == nil || !strings.Contains(err.Error(), "no record of run") {
+		t.Errorf("Expected an unknown run to be reported, got %v", err)
+	}
+
+	rollbackTo = "2024-03-01"
+	if err := rollbackBucket("bucket", ""); err == nil {
+		t.Errorf("Expected --to and --run together to be rejected")
+	}
+}
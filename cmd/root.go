@@ -10,6 +10,29 @@ import (
 var rootCmd = &cobra.Command{
 	Use:   "s3uploader",
 	Short: "S3 Uploader is a CLI tool to upload directories to S3",
+
+	PersistentPreRunE: applyConfig,
+}
+
+func init() {
+	rootCmd.PersistentFlags().StringVar(&configFile, "config", "", "Config file (default ~/.config/s3sync/config.yaml and ./.s3sync.yaml)")
+	rootCmd.PersistentFlags().StringVar(&configProfile, "config-profile", "", "Named profile to use from the config file")
+	rootCmd.PersistentFlags().StringVarP(&bucketName, "bucket", "b", "", "S3 bucket name")
+	rootCmd.PersistentFlags().StringVarP(&endpointURL, "endpoint", "e", "", "AWS Endpoint URL (for testing with LocalStack)")
+	rootCmd.PersistentFlags().StringVarP(&region, "region", "r", "", "AWS Region (default from AWS_REGION or the profile, else us-east-1)")
+	rootCmd.PersistentFlags().BoolVarP(&deleteExtra, "delete", "d", false, "Delete files at the destination that are not present in the source")
+	rootCmd.PersistentFlags().BoolVarP(&assumeYes, "yes", "y", false, "Delete without asking for confirmation; required for --delete when not run from a terminal")
+	rootCmd.PersistentFlags().StringVar(&maxDelete, "max-delete", "", "Abort before changing anything if --delete would remove more than this many keys, or this percentage (e.g. 10%)")
+	rootCmd.PersistentFlags().StringVar(&symlinkPolicy, "symlinks", symlinksFollow, "How to handle symbolic links: skip, follow or preserve")
+	rootCmd.PersistentFlags().BoolVar(&dirMarkers, "dir-markers", false, "Keep empty directories as zero-byte \"dir/\" marker objects")
+	rootCmd.PersistentFlags().BoolVar(&normalizeUnicode, "normalize-unicode", true, "Normalize keys to Unicode NFC")
+	rootCmd.PersistentFlags().BoolVar(&lowercaseKeys, "lowercase-keys", false, "Lower-case keys derived from local file names")
+	rootCmd.PersistentFlags().BoolVar(&escapeKeys, "escape-keys", false, "Percent-escape bytes in file names that are not valid UTF-8")
+	rootCmd.PersistentFlags().StringVar(&sseCKeyFile, "sse-c-key-file", "", "File holding a 256-bit customer-provided key for SSE-C")
+	rootCmd.PersistentFlags().StringVar(&encryptKeyFile, "encrypt-key-file", "", "File holding a 256-bit master key for client-side encryption")
+	rootCmd.PersistentFlags().StringVar(&encryptPassphraseFile, "encrypt-passphrase-file", "", "File holding a passphrase to derive the client-side encryption key from")
+	rootCmd.PersistentFlags().BoolVar(&encryptKeys, "encrypt-keys", false, "Encrypt each path segment of object keys with the client-side encryption key")
+	rootCmd.PersistentFlags().BoolVar(&preserveXattrs, "xattrs", false, "Preserve extended attributes and POSIX ACLs (Linux only)")
 }
 
 func Execute() {
@@ -0,0 +1,139 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// runRecordPrefix holds one record per run that changed the bucket, so that
+// a run can later be referred to by its ID, e.g. to roll it back.
+const runRecordPrefix = internalPrefix + "runs/"
+
+func runRecordKey(runID string) string {
+	return runRecordPrefix + runID + ".json"
+}
+
+// bucketVersioned reports whether versioning is enabled on the bucket. Runs
+// are only recorded there, since rolling one back needs the versions it
+// replaced.
+func bucketVersioned(s3Client *s3.S3, bucketName string) (bool, error) {
+	output, err := s3Client.GetBucketVersioning(&s3.GetBucketVersioningInput{
+		Bucket: aws.String(bucketName),
+	})
+	if err != nil {
+		return false, err
+	}
+	return aws.StringValue(output.Status) == s3.BucketVersioningStatusEnabled, nil
+}
+
+// recordRun stores the change event of a run in the bucket.
+func recordRun(s3Client *s3.S3, bucketName string, event *syncEvent) error {
+	body, err := json.MarshalIndent(event, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	input := &s3.PutObjectInput{
+		Bucket:      aws.String(bucketName),
+		Key:         aws.String(runRecordKey(event.RunID)),
+		Body:        bytes.NewReader(body),
+		ContentType: aws.String("application/json"),
+	}
+	applySSE(input)
+
+	_, err = s3Client.PutObject(input)
+	return err
+}
+
+// laterRuns returns the IDs of the recorded runs that started after run and
+// changed any of the keys it changed, oldest first.
+func laterRuns(s3Client *s3.S3, bucketName string, run *syncEvent) ([]string, error) {
+	changed := make(map[string]bool)
+	for _, keys := range [][]string{run.Uploaded, run.Deleted} {
+		for _, key := range keys {
+			changed[key] = true
+		}
+	}
+
+	var candidates []string
+	err := s3Client.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: aws.String(bucketName),
+		Prefix: aws.String(runRecordPrefix),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, obj := range page.Contents {
+			if aws.TimeValue(obj.LastModified).Before(run.StartedAt.Truncate(time.Second)) {
+				continue
+			}
+			runID := strings.TrimSuffix(strings.TrimPrefix(aws.StringValue(obj.Key), runRecordPrefix), ".json")
+			if runID != run.RunID {
+				candidates = append(candidates, runID)
+			}
+		}
+		return !lastPage
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list runs: %v", err)
+	}
+
+	var later []*syncEvent
+	for _, runID := range candidates {
+		event, err := loadRunRecord(s3Client, bucketName, runID)
+		if err != nil {
+			return nil, err
+		}
+		if !event.StartedAt.After(run.StartedAt) {
+			continue
+		}
+		for _, keys := range [][]string{event.Uploaded, event.Deleted} {
+			if slices.ContainsFunc(keys, func(key string) bool { return changed[key] }) {
+				later = append(later, event)
+				break
+			}
+		}
+	}
+
+	sort.Slice(later, func(i, j int) bool { return later[i].StartedAt.Before(later[j].StartedAt) })
+	runIDs := make([]string, len(later))
+	for i, event := range later {
+		runIDs[i] = event.RunID
+	}
+	return runIDs, nil
+}
+
+// loadRunRecord reads back the record written by recordRun.
+func loadRunRecord(s3Client *s3.S3, bucketName, runID string) (*syncEvent, error) {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(bucketName),
+		Key:    aws.String(runRecordKey(runID)),
+	}
+	applySSEToGet(input)
+
+	output, err := s3Client.GetObject(input)
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchKey {
+		return nil, fmt.Errorf("no record of run %s in bucket %s", runID, bucketName)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read record of run %s: %v", runID, err)
+	}
+	defer output.Body.Close()
+
+	data, err := io.ReadAll(output.Body)
+	if err != nil {
+		return nil, err
+	}
+	var event syncEvent
+	if err := json.Unmarshal(data, &event); err != nil {
+		return nil, fmt.Errorf("invalid record of run %s: %v", runID, err)
+	}
+	return &event, nil
+}
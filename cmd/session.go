@@ -0,0 +1,102 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+var (
+	awsProfile           string
+	accessKeyID          string
+	secretAccessKey      string
+	sessionToken         string
+	assumeRoleARN        string
+	roleSessionName      string
+	externalID           string
+	webIdentityTokenFile string
+	stsEndpointURL       string
+)
+
+func init() {
+	flags := rootCmd.PersistentFlags()
+	flags.StringVar(&awsProfile, "profile", "", "AWS shared config profile to use for credentials")
+	flags.StringVar(&accessKeyID, "access-key-id", "", "Static AWS access key ID (overrides the default credential chain)")
+	flags.StringVar(&secretAccessKey, "secret-access-key", "", "Static AWS secret access key")
+	flags.StringVar(&sessionToken, "session-token", "", "Session token to use with the static access key")
+	flags.StringVar(&assumeRoleARN, "assume-role-arn", "", "ARN of an IAM role to assume through STS")
+	flags.StringVar(&roleSessionName, "role-session-name", "s3sync", "Session name used when assuming a role")
+	flags.StringVar(&externalID, "external-id", "", "External ID passed when assuming a role")
+	flags.StringVar(&webIdentityTokenFile, "web-identity-token-file", "", "OIDC token file used to assume --assume-role-arn with web identity")
+	flags.StringVar(&stsEndpointURL, "sts-endpoint", "", "Custom STS endpoint URL used when assuming a role")
+}
+
+// defaultRegion is used when neither --region nor the AWS configuration
+// names a region.
+const defaultRegion = "us-east-1"
+
+// newSession builds the AWS session shared by all commands. The endpoint only
+// changes where requests are sent; credentials come from the standard chain
+// (environment, shared config and credentials files, credential_process, web
+// identity, instance roles) unless static keys are given explicitly, and may
+// then be exchanged for an assumed role.
+func newSession() (*session.Session, error) {
+	// Without --region, the region comes from AWS_REGION or the profile
+	var config aws.Config
+	if region != "" {
+		config.Region = aws.String(region)
+	}
+
+	if endpointURL != "" {
+		config.Endpoint = aws.String(endpointURL)
+		config.S3ForcePathStyle = aws.Bool(true)
+	}
+
+	if accessKeyID != "" || secretAccessKey != "" {
+		if accessKeyID == "" || secretAccessKey == "" {
+			return nil, fmt.Errorf("--access-key-id and --secret-access-key must be given together")
+		}
+		config.Credentials = credentials.NewStaticCredentials(accessKeyID, secretAccessKey, sessionToken)
+	}
+
+	sess, err := session.NewSessionWithOptions(session.Options{
+		Config:            config,
+		Profile:           awsProfile,
+		SharedConfigState: session.SharedConfigEnable,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create AWS session: %v", err)
+	}
+	if aws.StringValue(sess.Config.Region) == "" {
+		sess.Config.Region = aws.String(defaultRegion)
+	}
+
+	if assumeRoleARN == "" {
+		if webIdentityTokenFile != "" {
+			return nil, fmt.Errorf("--web-identity-token-file requires --assume-role-arn")
+		}
+		return sess, nil
+	}
+
+	// STS must not inherit the S3 endpoint override.
+	stsClient := sts.New(sess, &aws.Config{Endpoint: aws.String(stsEndpointURL)})
+
+	var creds *credentials.Credentials
+	if webIdentityTokenFile != "" {
+		creds = credentials.NewCredentials(stscreds.NewWebIdentityRoleProviderWithOptions(
+			stsClient, assumeRoleARN, roleSessionName, stscreds.FetchTokenPath(webIdentityTokenFile)))
+	} else {
+		creds = stscreds.NewCredentialsWithClient(stsClient, assumeRoleARN, func(p *stscreds.AssumeRoleProvider) {
+			p.RoleSessionName = roleSessionName
+			if externalID != "" {
+				p.ExternalID = aws.String(externalID)
+			}
+		})
+	}
+
+	return sess.Copy(&aws.Config{Credentials: creds}), nil
+}
@@ -0,0 +1,155 @@
+package cmd
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const assumeRoleResponse = `<AssumeRoleResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <AssumeRoleResult>
+    <Credentials>
+      <AccessKeyId>ASIAASSUMED</AccessKeyId>
+      <SecretAccessKey>assumed-secret</SecretAccessKey>
+      <SessionToken>assumed-token</SessionToken>
+      <Expiration>2099-01-01T00:00:00Z</Expiration>
+    </Credentials>
+    <AssumedRoleUser>
+      <Arn>arn:aws:sts::123456789012:assumed-role/sync/s3sync</Arn>
+      <AssumedRoleId>AROAEXAMPLE:s3sync</AssumedRoleId>
+    </AssumedRoleUser>
+  </AssumeRoleResult>
+  <ResponseMetadata><RequestId>1</RequestId></ResponseMetadata>
+</AssumeRoleResponse>`
+
+// isolateAWSConfig keeps the developer's own AWS configuration out of a test
+// and resets the credential flags when it finishes.
+func isolateAWSConfig(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("AWS_CONFIG_FILE", filepath.Join(dir, "config"))
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(dir, "credentials"))
+	for _, name := range []string{"AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "AWS_SESSION_TOKEN", "AWS_PROFILE", "AWS_ROLE_ARN", "AWS_WEB_IDENTITY_TOKEN_FILE", "AWS_CA_BUNDLE", "AWS_REGION", "AWS_DEFAULT_REGION"} {
+		t.Setenv(name, "")
+		os.Unsetenv(name)
+	}
+
+	t.Cleanup(func() {
+		endpointURL, awsProfile, region = "", "", ""
+		accessKeyID, secretAccessKey, sessionToken = "", "", ""
+		assumeRoleARN, externalID, webIdentityTokenFile, stsEndpointURL = "", "", "", ""
+	})
+}
+
+func TestNewSessionEndpointKeepsCredentialChain(t *testing.T) {
+	isolateAWSConfig(t)
+	t.Setenv("AWS_ACCESS_KEY_ID", "minio-key")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "minio-secret")
+	endpointURL = "http://localhost:9000"
+
+	sess, err := newSession()
+	if err != nil {
+		t.Fatalf("newSession failed: %v", err)
+	}
+	creds, err := sess.Config.Credentials.Get()
+	if err != nil {
+		t.Fatalf("Failed to resolve credentials: %v", err)
+	}
+	if creds.AccessKeyID != "minio-key" {
+		t.Errorf("Expected credentials from the environment, got %q", creds.AccessKeyID)
+	}
+}
+
+func TestNewSessionProfile(t *testing.T) {
+	isolateAWSConfig(t)
+	credsFile := filepath.Join(t.TempDir(), "credentials")
+	os.WriteFile(credsFile, []byte("[ceph]\naws_access_key_id = ceph-key\naws_secret_access_key = ceph-secret\n"), 0600)
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", credsFile)
+	awsProfile = "ceph"
+
+	sess, err := newSession()
+	if err != nil {
+		t.Fatalf("newSession failed: %v", err)
+	}
+	creds, err := sess.Config.Credentials.Get()
+	if err != nil {
+		t.Fatalf("Failed to resolve credentials: %v", err)
+	}
+	if creds.AccessKeyID != "ceph-key" {
+		t.Errorf("Expected credentials from profile ceph, got %q", creds.AccessKeyID)
+	}
+}
+
+func TestNewSessionAssumeRole(t *testing.T) {
+	isolateAWSConfig(t)
+
+	var action, roleARN, extID string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		action = r.Form.Get("Action")
+		roleARN = r.Form.Get("RoleArn")
+		extID = r.Form.Get("ExternalId")
+		w.Header().Set("Content-Type", "text/xml")
+		w.Write([]byte(assumeRoleResponse))
+	}))
+	defer server.Close()
+
+	accessKeyID = "base-key"
+	secretAccessKey = "base-secret"
+	assumeRoleARN = "arn:aws:iam::123456789012:role/sync"
+	externalID = "partner"
+	stsEndpointURL = server.URL
+
+	sess, err := newSession()
+	if err != nil {
+		t.Fatalf("newSession failed: %v", err)
+	}
+	creds, err := sess.Config.Credentials.Get()
+	if err != nil {
+		t.Fatalf("Failed to assume role: %v", err)
+	}
+
+	if action != "AssumeRole" || roleARN != assumeRoleARN || extID != "partner" {
+		t.Errorf("Unexpected STS request: action=%q role=%q externalId=%q", action, roleARN, extID)
+	}
+	if creds.AccessKeyID != "ASIAASSUMED" || creds.SessionToken != "assumed-token" {
+		t.Errorf("Expected assumed role credentials, got %+v", creds)
+	}
+}
+
+func TestNewSessionRejectsPartialStaticKeys(t *testing.T) {
+	isolateAWSConfig(t)
+	accessKeyID = "only-key"
+
+	if _, err := newSession(); err == nil {
+		t.Fatal("Expected an error when only the access key ID is given")
+	}
+}
+
+func TestNewSessionRegion(t *testing.T) {
+	isolateAWSConfig(t)
+	configFile := filepath.Join(t.TempDir(), "config")
+	os.WriteFile(configFile, []byte("[profile eu]\nregion = eu-west-1\n"), 0600)
+	t.Setenv("AWS_CONFIG_FILE", configFile)
+
+	cases := []struct {
+		flag, env, profile, want string
+	}{
+		{"", "", "", defaultRegion},
+		{"", "ap-south-1", "", "ap-south-1"},
+		{"", "", "eu", "eu-west-1"},
+		{"us-west-2", "ap-south-1", "eu", "us-west-2"},
+	}
+	for _, c := range cases {
+		region, awsProfile = c.flag, c.profile
+		t.Setenv("AWS_REGION", c.env)
+		sess, err := newSession()
+		if err != nil {
+			t.Fatalf("newSession failed: %v", err)
+		}
+		if got := *sess.Config.Region; got != c.want {
+			t.Errorf("--region %q, AWS_REGION %q, profile %q: expected region %s, got %s", c.flag, c.env, c.profile, c.want, got)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package cmd
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+var (
+	sseMode     string
+	sseKMSKeyID string
+	sseCKeyFile string
+
+	// sseCKey is the customer-provided key read from --sse-c-key-file.
+	sseCKey []byte
+)
+
+// loadSSEConfig validates the encryption flags and reads the SSE-C key, which
+// may be stored as 32 raw bytes or base64-encoded.
+func loadSSEConfig() error {
+	switch sseMode {
+	case "", s3.ServerSideEncryptionAes256, s3.ServerSideEncryptionAwsKms, s3.ServerSideEncryptionAwsKmsDsse:
+	default:
+		return fmt.Errorf("invalid --sse value %q (want AES256, aws:kms or aws:kms:dsse)", sseMode)
+	}
+	if sseKMSKeyID != "" && !strings.HasPrefix(sseMode, s3.ServerSideEncryptionAwsKms) {
+		return fmt.Errorf("--sse-kms-key-id requires --sse aws:kms")
+	}
+
+	sseCKey = nil
+	if sseCKeyFile == "" {
+		return nil
+	}
+	if sseMode != "" {
+		return fmt.Errorf("--sse-c-key-file cannot be combined with --sse")
+	}
+
+	key, err := readKeyFile(sseCKeyFile)
+	if err != nil {
+		return fmt.Errorf("invalid SSE-C key: %v", err)
+	}
+	sseCKey = key
+	return nil
+}
+
+// readKeyFile reads a 256-bit key stored as 32 raw bytes or base64-encoded.
+func readKeyFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) != 32 {
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+		if err != nil || len(decoded) != 32 {
+			return nil, fmt.Errorf("key in %s must be 32 bytes, raw or base64-encoded", path)
+		}
+		data = decoded
+	}
+	return data, nil
+}
+
+// applySSE sets the configured server-side encryption on an upload. For
+// SSE-C the SDK base64-encodes the key and adds its MD5 itself.
+func applySSE(input *s3.PutObjectInput) {
+	if sseMode != "" {
+		input.ServerSideEncryption = aws.String(sseMode)
+	}
+	if sseKMSKeyID != "" {
+		input.SSEKMSKeyId = aws.String(sseKMSKeyID)
+	}
+	if sseCKey != nil {
+		input.SSECustomerAlgorithm = aws.String(s3.ServerSideEncryptionAes256)
+		input.SSECustomerKey = aws.String(string(sseCKey))
+	}
+}
+
+func applySSEToGet(input *s3.GetObjectInput) {
+	if sseCKey != nil {
+		input.SSECustomerAlgorithm = aws.String(s3.ServerSideEncryptionAes256)
+		input.SSECustomerKey = aws.String(string(sseCKey))
+	}
+}
+
+func applySSEToHead(input *s3.HeadObjectInput) {
+	if sseCKey != nil {
+		input.SSECustomerAlgorithm = aws.String(s3.ServerSideEncryptionAes256)
+		input.SSECustomerKey = aws.String(string(sseCKey))
+	}
+}
+
+// headObject runs HeadObject with the SSE-C key, if there is one. S3 rejects
+// the key for objects that are not encrypted with SSE-C, such as those
+// uploaded before --sse-c-key-file was used, so those are asked for again
+// without it.
+func headObject(s3Client *s3.S3, input *s3.HeadObjectInput) (*s3.HeadObjectOutput, error) {
+	applySSEToHead(input)
+	output, err := s3Client.HeadObject(input)
+	if aerr, ok := err.(awserr.RequestFailure); ok && aerr.StatusCode() == 400 && input.SSECustomerKey != nil {
+		input.SSECustomerAlgorithm, input.SSECustomerKey = nil, nil
+		return s3Client.HeadObject(input)
+	}
+	return output, err
+}
+
+// applySSEToCopy re-applies the configured encryption to a copy, which would
+// otherwise fall back to the bucket default. With SSE-C the source must be
+// decrypted with the same key.
+func applySSEToCopy(input *s3.CopyObjectInput) {
+	if sseMode != "" {
+		input.ServerSideEncryption = aws.String(sseMode)
+	}
+	if sseKMSKeyID != "" {
+		input.SSEKMSKeyId = aws.String(sseKMSKeyID)
+	}
+	if sseCKey != nil {
+		input.SSECustomerAlgorithm = aws.String(s3.ServerSideEncryptionAes256)
+		input.SSECustomerKey = aws.String(string(sseCKey))
+		input.CopySourceSSECustomerAlgorithm = aws.String(s3.ServerSideEncryptionAes256)
+		input.CopySourceSSECustomerKey = aws.String(string(sseCKey))
+	}
+}
+
+// applySourceSSE makes a copy keep the encryption of its source, as read with
+// HeadObject, rather than falling back to the bucket default. SSE-C sources
+// are re-encrypted with the same customer key.
+func applySourceSSE(input *s3.CopyObjectInput, source *s3.HeadObjectOutput) {
+	if source.SSECustomerAlgorithm != nil && sseCKey != nil {
+		input.SSECustomerAlgorithm = aws.String(s3.ServerSideEncryptionAes256)
+		input.SSECustomerKey = aws.String(string(sseCKey))
+		input.CopySourceSSECustomerAlgorithm = aws.String(s3.ServerSideEncryptionAes256)
+		input.CopySourceSSECustomerKey = aws.String(string(sseCKey))
+		return
+	}
+	input.ServerSideEncryption = source.ServerSideEncryption
+	input.SSEKMSKeyId = source.SSEKMSKeyId
+	input.BucketKeyEnabled = source.BucketKeyEnabled
+}
@@ -0,0 +1,116 @@
+package cmd
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func resetSSEFlags() {
+	sseMode, sseKMSKeyID, sseCKeyFile, sseCKey = "", "", "", nil
+}
+
+func TestLoadSSEConfig(t *testing.T) {
+	defer resetSSEFlags()
+	dir := t.TempDir()
+	key := []byte("0123456789abcdef0123456789abcdef")
+
+	rawPath := filepath.Join(dir, "raw.key")
+	os.WriteFile(rawPath, key, 0600)
+	encodedPath := filepath.Join(dir, "encoded.key")
+	os.WriteFile(encodedPath, []byte(base64.StdEncoding.EncodeToString(key)+"\n"), 0600)
+	shortPath := filepath.Join(dir, "short.key")
+	os.WriteFile(shortPath, []byte("too short"), 0600)
+
+	for _, path := range []string{rawPath, encodedPath} {
+		resetSSEFlags()
+		sseCKeyFile = path
+		if err := loadSSEConfig(); err != nil {
+			t.Fatalf("loadSSEConfig(%s) failed: %v", path, err)
+		}
+		if string(sseCKey) != string(key) {
+			t.Errorf("Unexpected key loaded from %s", path)
+		}
+	}
+
+	invalid := []func(){
+		func() { sseMode = "rot13" },
+		func() { sseMode = "AES256"; sseKMSKeyID = "alias/data" },
+		func() { sseMode = "aws:kms"; sseCKeyFile = rawPath },
+		func() { sseCKeyFile = shortPath },
+	}
+	for i, setup := range invalid {
+		resetSSEFlags()
+		setup()
+		if err := loadSSEConfig(); err == nil {
+			t.Errorf("Expected invalid combination %d to be rejected", i)
+		}
+	}
+}
+
+func TestApplySSE(t *testing.T) {
+	defer resetSSEFlags()
+
+	sseMode, sseKMSKeyID = "aws:kms", "alias/data"
+	if err := loadSSEConfig(); err != nil {
+		t.Fatalf("loadSSEConfig failed: %v", err)
+	}
+	input := &s3.PutObjectInput{}
+	applySSE(input)
+	if *input.ServerSideEncryption != "aws:kms" || *input.SSEKMSKeyId != "alias/data" || input.SSECustomerKey != nil {
+		t.Errorf("Unexpected KMS settings: %v", input)
+	}
+
+	resetSSEFlags()
+	sseCKey = []byte("0123456789abcdef0123456789abcdef")
+	get := &s3.GetObjectInput{}
+	applySSEToGet(get)
+	if *get.SSECustomerAlgorithm != "AES256" || *get.SSECustomerKey != string(sseCKey) {
+		t.Errorf("Expected SSE-C key on GetObject, got %v", get)
+	}
+}
+
+func TestSameContentWithSSECOnPlainObject(t *testing.T) {
+	defer resetSSEFlags()
+	sseCKey = []byte("0123456789abcdef0123456789abcdef")
+	isolateAWSConfig(t)
+
+	// S3 refuses an SSE-C key for objects that are not encrypted with one,
+	// and the SDK only sends keys over TLS
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Amz-Server-Side-Encryption-Customer-Key") != "" && r.URL.Path == "/bucket/plain" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("X-Amz-Meta-S3sync-Md5", "abc123")
+	}))
+	defer server.Close()
+
+	sess, err := session.NewSession(&aws.Config{
+		Region:           aws.String("us-east-1"),
+		Endpoint:         aws.String(server.URL),
+		Credentials:      credentials.NewStaticCredentials("test", "test", ""),
+		S3ForcePathStyle: aws.Bool(true),
+		MaxRetries:       aws.Int(0),
+		HTTPClient:       server.Client(),
+	})
+	if err != nil {
+		t.Fatalf("Failed to create AWS session: %v", err)
+	}
+	client := s3.New(sess)
+
+	if same, err := sameContent(client, "bucket", "plain", "other-etag", "abc123"); err != nil || !same {
+		t.Errorf("Expected the plain object to be compared without the key: same=%v err=%v", same, err)
+	}
+	if same, err := sameContent(client, "bucket", "sse-c", "other-etag", "abc123"); err != nil || !same {
+		t.Errorf("Expected the SSE-C object to be compared with the key: same=%v err=%v", same, err)
+	}
+}
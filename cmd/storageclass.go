@@ -0,0 +1,124 @@
+package cmd
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+var (
+	storageClass      string
+	storageClassRules []string
+
+	compiledClassRules []storageClassRule
+)
+
+// storageClassRule assigns a storage class to keys matching a pattern, given
+// on the command line as "pattern=CLASS".
+type storageClassRule struct {
+	glob  *globPattern
+	class string
+}
+
+// loadStorageClassConfig validates --storage-class and compiles the
+// --storage-class-rule flags.
+func loadStorageClassConfig() error {
+	compiledClassRules = nil
+	if storageClass != "" && !validStorageClass(storageClass) {
+		return fmt.Errorf("invalid --storage-class %q (want one of %s)", storageClass, strings.Join(s3.StorageClass_Values(), ", "))
+	}
+
+	for _, rule := range storageClassRules {
+		i := strings.LastIndex(rule, "=")
+		if i <= 0 {
+			return fmt.Errorf("invalid --storage-class-rule %q (want pattern=CLASS)", rule)
+		}
+		pattern, class := strings.TrimSpace(rule[:i]), strings.TrimSpace(rule[i+1:])
+		if !validStorageClass(class) {
+			return fmt.Errorf("invalid storage class %q in rule %q", class, rule)
+		}
+		glob, err := compileGlob(pattern)
+		if err != nil {
+			return fmt.Errorf("invalid pattern %q in --storage-class-rule: %v", pattern, err)
+		}
+		compiledClassRules = append(compiledClassRules, storageClassRule{glob: glob, class: class})
+	}
+	return nil
+}
+
+func validStorageClass(class string) bool {
+	for _, value := range s3.StorageClass_Values() {
+		if class == value {
+			return true
+		}
+	}
+	return false
+}
+
+// storageClassFor returns the storage class key should be stored in, or ""
+// to leave it to the bucket default. Rules are applied in order, so the last
+// matching rule wins over earlier ones and over --storage-class. Directory
+// markers always stay in the default class.
+func storageClassFor(key string) string {
+	if isDirMarker(key) {
+		return ""
+	}
+	class := storageClass
+	for _, rule := range compiledClassRules {
+		if rule.glob.match(key) {
+			class = rule.class
+		}
+	}
+	return class
+}
+
+func applyStorageClass(input *s3.PutObjectInput, key string) {
+	if class := storageClassFor(key); class != "" {
+		input.StorageClass = aws.String(class)
+	}
+}
+
+// listedStorageClass normalizes the storage class reported by a listing,
+// which omits it for STANDARD on some S3-compatible stores.
+func listedStorageClass(obj *s3.Object) string {
+	if obj.StorageClass == nil || *obj.StorageClass == "" {
+		return s3.StorageClassStandard
+	}
+	return *obj.StorageClass
+}
+
+// isArchived reports whether objects in class must be restored before they
+// can be read or copied.
+func isArchived(class string) bool {
+	return class == s3.StorageClassGlacier || class == s3.StorageClassDeepArchive
+}
+
+// transitionObject moves an object to another storage class by copying it
+// onto itself, which keeps its content, metadata and tags.
+func transitionObject(s3Client *s3.S3, bucketName, key, class string) error {
+	stored := remoteKey(key)
+	input := &s3.CopyObjectInput{
+		Bucket:            aws.String(bucketName),
+		Key:               aws.String(stored),
+		CopySource:        aws.String(bucketName + "/" + escapeCopyKey(stored)),
+		StorageClass:      aws.String(class),
+		MetadataDirective: aws.String(s3.MetadataDirectiveCopy),
+	}
+	applySSEToCopy(input)
+	applyACLToCopy(input)
+
+	_, err := s3Client.CopyObject(input)
+	return err
+}
+
+// escapeCopyKey URL-encodes a key for the CopySource header, keeping "/".
+func escapeCopyKey(key string) string {
+	segments := strings.Split(key, "/")
+	for i, segment := range segments {
+		segments[i] = strings.ReplaceAll(url.QueryEscape(segment), "+", "%20")
+	}
+	return strings.Join(segments, "/")
+}
@@ -0,0 +1,69 @@
+package cmd
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestStorageClassFor(t *testing.T) {
+	defer func() {
+		storageClass, storageClassRules = "", nil
+		loadStorageClassConfig()
+	}()
+
+	if got := storageClassFor("a.txt"); got != "" {
+		t.Errorf("Expected the bucket default without flags, got %q", got)
+	}
+
+	storageClass = "STANDARD"
+	storageClassRules = []string{"archives/**=GLACIER_IR", "*.log=STANDARD_IA", "archives/keep/*.log=STANDARD"}
+	if err := loadStorageClassConfig(); err != nil {
+		t.Fatalf("loadStorageClassConfig failed: %v", err)
+	}
+
+	tests := map[string]string{
+		"docs/readme.md":         "STANDARD",
+		"archives/2020/data.tar": "GLACIER_IR",
+		"app/server.log":         "STANDARD_IA",
+		"archives/keep/app.log":  "STANDARD",
+		"archives/empty/":        "",
+	}
+	for key, want := range tests {
+		if got := storageClassFor(key); got != want {
+			t.Errorf("storageClassFor(%q) = %q, want %q", key, got, want)
+		}
+	}
+
+	for _, invalid := range [][]string{{"*.log"}, {"*.log=COLD"}, {"=STANDARD"}} {
+		storageClass, storageClassRules = "", invalid
+		if err := loadStorageClassConfig(); err == nil {
+			t.Errorf("Expected rule %q to be rejected", invalid[0])
+		}
+	}
+	storageClass, storageClassRules = "FROZEN", nil
+	if err := loadStorageClassConfig(); err == nil {
+		t.Errorf("Expected an unknown storage class to be rejected")
+	}
+}
+
+func TestTransitionObject(t *testing.T) {
+	client := newFakeS3Client(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut || r.URL.Path != "/bucket/logs/a b+c.log" {
+			t.Errorf("Unexpected request %s %s", r.Method, r.URL.Path)
+		}
+		if got := r.Header.Get("X-Amz-Copy-Source"); got != "bucket/logs/a%20b%2Bc.log" {
+			t.Errorf("Unexpected copy source %q", got)
+		}
+		if got := r.Header.Get("X-Amz-Storage-Class"); got != "STANDARD_IA" {
+			t.Errorf("Unexpected storage class %q", got)
+		}
+		if got := r.Header.Get("X-Amz-Metadata-Directive"); got != "COPY" {
+			t.Errorf("Expected metadata to be copied, got %q", got)
+		}
+		w.Write([]byte(`<CopyObjectResult><ETag>"abc"</ETag></CopyObjectResult>`))
+	})
+
+	if err := transitionObject(client, "bucket", "logs/a b+c.log", "STANDARD_IA"); err != nil {
+		t.Fatalf("transitionObject failed: %v", err)
+	}
+}
@@ -0,0 +1,184 @@
+package cmd
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"gopkg.in/yaml.v3"
+)
+
+// S3 limits on object tags.
+const (
+	maxObjectTags  = 10
+	maxTagKeyLen   = 128
+	maxTagValueLen = 256
+)
+
+var (
+	objectTags   []string
+	tagRulesFile string
+	filterTags   []string
+
+	baseTags  map[string]string
+	tagRules  []tagRule
+	tagFilter map[string]*string
+)
+
+// tagRule adds tags to every uploaded object whose key matches Pattern.
+type tagRule struct {
+	Pattern string            `yaml:"pattern"`
+	Tags    map[string]string `yaml:"tags"`
+
+	glob *globPattern
+}
+
+// loadTagConfig parses --tag, --tag-rules and --filter-tag.
+func loadTagConfig() error {
+	baseTags, tagRules, tagFilter = nil, nil, nil
+
+	if len(objectTags) > 0 {
+		baseTags = make(map[string]string, len(objectTags))
+		for _, tag := range objectTags {
+			key, value, ok := strings.Cut(tag, "=")
+			if !ok {
+				return fmt.Errorf("invalid --tag %q (want key=value)", tag)
+			}
+			if err := validateTag(key, value); err != nil {
+				return err
+			}
+			baseTags[key] = value
+		}
+	}
+
+	if tagRulesFile != "" {
+		data, err := os.ReadFile(tagRulesFile)
+		if err != nil {
+			return fmt.Errorf("failed to read tag rules: %v", err)
+		}
+		if err := yaml.Unmarshal(data, &tagRules); err != nil {
+			return fmt.Errorf("failed to parse tag rules %s: %v", tagRulesFile, err)
+		}
+		for i := range tagRules {
+			rule := &tagRules[i]
+			if rule.Pattern == "" {
+				return fmt.Errorf("tag rule %d has no pattern", i+1)
+			}
+			rule.glob, err = compileGlob(rule.Pattern)
+			if err != nil {
+				return fmt.Errorf("invalid pattern %q in tag rules: %v", rule.Pattern, err)
+			}
+			for key, value := range rule.Tags {
+				if err := validateTag(key, value); err != nil {
+					return fmt.Errorf("%v in rule for %q", err, rule.Pattern)
+				}
+			}
+		}
+	}
+
+	if len(filterTags) > 0 {
+		tagFilter = make(map[string]*string, len(filterTags))
+		for _, tag := range filterTags {
+			if key, value, ok := strings.Cut(tag, "="); ok {
+				tagFilter[key] = aws.String(value)
+			} else {
+				// A bare key only requires the tag to be present
+				tagFilter[tag] = nil
+			}
+		}
+	}
+
+	return nil
+}
+
+func validateTag(key, value string) error {
+	if key == "" || len(key) > maxTagKeyLen {
+		return fmt.Errorf("invalid tag key %q (1 to %d characters)", key, maxTagKeyLen)
+	}
+	if len(value) > maxTagValueLen {
+		return fmt.Errorf("value of tag %q is longer than %d characters", key, maxTagValueLen)
+	}
+	return nil
+}
+
+// tagsFor merges --tag with every matching tag rule, later rules overriding
+// earlier ones.
+func tagsFor(key string) (map[string]string, error) {
+	tags := make(map[string]string, len(baseTags))
+	for k, v := range baseTags {
+		tags[k] = v
+	}
+	for _, rule := range tagRules {
+		if !rule.glob.match(key) {
+			continue
+		}
+		for k, v := range rule.Tags {
+			tags[k] = v
+		}
+	}
+	if len(tags) > maxObjectTags {
+		return nil, fmt.Errorf("%s would get %d tags, but S3 allows at most %d", key, len(tags), maxObjectTags)
+	}
+	return tags, nil
+}
+
+// applyTags sets the Tagging header of an upload.
+func applyTags(input *s3.PutObjectInput, key string) error {
+	tags, err := tagsFor(key)
+	if err != nil || len(tags) == 0 {
+		return err
+	}
+	values := url.Values{}
+	for k, v := range tags {
+		values.Set(k, v)
+	}
+	input.Tagging = aws.String(values.Encode())
+	return nil
+}
+
+// filterByTags removes from objects every key whose tags do not match
+// --filter-tag, so that it is treated as if it were not in the bucket.
+func filterByTags(s3Client *s3.S3, bucketName string, objects map[string]string) error {
+	if len(tagFilter) == 0 {
+		return nil
+	}
+
+	keys := make([]string, 0, len(objects))
+	for key := range objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		output, err := s3Client.GetObjectTagging(&s3.GetObjectTaggingInput{
+			Bucket:    aws.String(bucketName),
+			Key:       aws.String(remoteKey(key)),
+			VersionId: objectVersion(key),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to get tags of %s: %v", key, err)
+		}
+		if !matchesTagFilter(output.TagSet) {
+			delete(objects, key)
+		}
+	}
+	return nil
+}
+
+func matchesTagFilter(tagSet []*s3.Tag) bool {
+	tags := make(map[string]string, len(tagSet))
+	for _, tag := range tagSet {
+		tags[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+	}
+	for key, want := range tagFilter {
+		value, ok := tags[key]
+		if !ok || (want != nil && value != *want) {
+			return false
+		}
+	}
+	return true
+}
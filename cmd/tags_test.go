@@ -0,0 +1,102 @@
+package cmd
+
+import (
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func resetTagFlags() {
+	objectTags, tagRulesFile, filterTags = nil, "", nil
+	loadTagConfig()
+}
+
+func TestApplyTags(t *testing.T) {
+	defer resetTagFlags()
+
+	rulesPath := filepath.Join(t.TempDir(), "tags.yaml")
+	os.WriteFile(rulesPath, []byte(`
+- pattern: "archives/**"
+  tags:
+    retention: long
+- pattern: "*.log"
+  tags:
+    retention: short
+    kind: log
+`), 0644)
+
+	objectTags = []string{"team=data", "retention=default"}
+	tagRulesFile = rulesPath
+	if err := loadTagConfig(); err != nil {
+		t.Fatalf("loadTagConfig failed: %v", err)
+	}
+
+	tests := map[string]url.Values{
+		"docs/a.txt":          {"team": {"data"}, "retention": {"default"}},
+		"archives/2020.tar":   {"team": {"data"}, "retention": {"long"}},
+		"archives/server.log": {"team": {"data"}, "retention": {"short"}, "kind": {"log"}},
+	}
+	for key, want := range tests {
+		input := &s3.PutObjectInput{}
+		if err := applyTags(input, key); err != nil {
+			t.Fatalf("applyTags(%q) failed: %v", key, err)
+		}
+		if got := *input.Tagging; got != want.Encode() {
+			t.Errorf("applyTags(%q) = %q, want %q", key, got, want.Encode())
+		}
+	}
+
+	for _, invalid := range []string{"novalue", "=value"} {
+		objectTags, tagRulesFile = []string{invalid}, ""
+		if err := loadTagConfig(); err == nil {
+			t.Errorf("Expected --tag %q to be rejected", invalid)
+		}
+	}
+
+	objectTags = nil
+	for i := 0; i <= maxObjectTags; i++ {
+		objectTags = append(objectTags, string(rune('a'+i))+"=x")
+	}
+	if err := loadTagConfig(); err != nil {
+		t.Fatalf("loadTagConfig failed: %v", err)
+	}
+	if err := applyTags(&s3.PutObjectInput{}, "a.txt"); err == nil {
+		t.Errorf("Expected more than %d tags to be rejected", maxObjectTags)
+	}
+}
+
+func TestFilterByTags(t *testing.T) {
+	defer resetTagFlags()
+
+	tagSets := map[string]string{
+		"/bucket/public.txt":  `<Tag><Key>class</Key><Value>public</Value></Tag><Tag><Key>team</Key><Value>data</Value></Tag>`,
+		"/bucket/private.txt": `<Tag><Key>class</Key><Value>private</Value></Tag><Tag><Key>team</Key><Value>data</Value></Tag>`,
+		"/bucket/other.txt":   `<Tag><Key>class</Key><Value>public</Value></Tag>`,
+	}
+	client := newFakeS3Client(t, func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := r.URL.Query()["tagging"]; !ok {
+			t.Errorf("Unexpected request %s %s", r.Method, r.URL)
+		}
+		w.Write([]byte(`<Tagging><TagSet>` + tagSets[r.URL.Path] + `</TagSet></Tagging>`))
+	})
+
+	objects := map[string]string{"public.txt": "1", "private.txt": "2", "other.txt": "3", "untagged.txt": "4"}
+	if err := filterByTags(client, "bucket", objects); err != nil || len(objects) != 4 {
+		t.Fatalf("Expected no filtering without --filter-tag: %v, %v", objects, err)
+	}
+
+	filterTags = []string{"class=public", "team"}
+	if err := loadTagConfig(); err != nil {
+		t.Fatalf("loadTagConfig failed: %v", err)
+	}
+	if err := filterByTags(client, "bucket", objects); err != nil {
+		t.Fatalf("filterByTags failed: %v", err)
+	}
+	if len(objects) != 1 || objects["public.txt"] != "1" {
+		t.Errorf("Expected only public.txt to remain, got %v", objects)
+	}
+}
@@ -0,0 +1,361 @@
+package cmd
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/spf13/cobra"
+)
+
+// trashPrefix holds objects removed by upload --delete-mode=trash, grouped by
+// the run that removed them, as .trash/<run-id>/<key>.
+const trashPrefix = ".trash/"
+
+const (
+	deleteModeDelete = "delete"
+	deleteModeTrash  = "trash"
+)
+
+var (
+	deleteMode string
+
+	trashRun       string
+	trashKeyPrefix string
+	trashOverwrite bool
+	trashOlderThan string
+	trashAll       bool
+)
+
+var trashCmd = &cobra.Command{
+	Use:   "trash",
+	Short: "List, restore or purge objects removed with --delete-mode=trash",
+}
+
+var trashListCmd = &cobra.Command{
+	Use:     "list",
+	Short:   "List objects in the trash, grouped by the run that removed them",
+	PreRunE: requireFlags("bucket"),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return listTrashCmd(bucketName)
+	},
+}
+
+var trashRestoreCmd = &cobra.Command{
+	Use:     "restore",
+	Short:   "Move objects removed by a run back to their original keys",
+	PreRunE: requireFlags("bucket", "run"),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return restoreTrash(bucketName, trashRun, trashKeyPrefix)
+	},
+}
+
+var trashPurgeCmd = &cobra.Command{
+	Use:     "purge",
+	Short:   "Permanently delete objects from the trash",
+	PreRunE: requireFlags("bucket"),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return purgeTrash(bucketName)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(trashCmd)
+	trashCmd.AddCommand(trashListCmd, trashRestoreCmd, trashPurgeCmd)
+	uploadCmd.Flags().StringVar(&deleteMode, "delete-mode", deleteModeDelete, "How --delete removes objects: delete, or trash to move them under .trash/<run-id>/")
+	trashListCmd.Flags().StringVar(&trashRun, "run", "", "Only list objects removed by this run")
+	trashRestoreCmd.Flags().StringVar(&trashRun, "run", "", "ID of the run whose removed objects are restored")
+	trashRestoreCmd.Flags().StringVar(&trashKeyPrefix, "prefix", "", "Only restore keys under this prefix")
+	trashRestoreCmd.Flags().BoolVar(&trashOverwrite, "overwrite", false, "Replace objects that exist again at the original key")
+	trashPurgeCmd.Flags().StringVar(&trashRun, "run", "", "Purge the objects removed by this run")
+	trashPurgeCmd.Flags().StringVar(&trashOlderThan, "older-than", "", "Purge objects moved to the trash longer ago than this duration, e.g. 720h")
+	trashPurgeCmd.Flags().BoolVar(&trashAll, "all", false, "Purge the whole trash")
+}
+
+func validateDeleteMode() error {
+	switch deleteMode {
+	case deleteModeDelete, deleteModeTrash:
+		return nil
+	}
+	return fmt.Errorf("invalid --delete-mode %q (want delete or trash)", deleteMode)
+}
+
+func trashKey(runID, storedKey string) string {
+	return trashPrefix + runID + "/" + storedKey
+}
+
+// moveObject copies an object to a new key and deletes the original. The
+// copy keeps the metadata, tags, encryption and ACL, and the storage class if
+// one is given.
+func moveObject(s3Client *s3.S3, bucketName, from, to, class string) error {
+	if err := copyObject(s3Client, bucketName, from, nil, to, class); err != nil {
+		return err
+	}
+	_, err := s3Client.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(bucketName),
+		Key:    aws.String(from),
+	})
+	return err
+}
+
+// moveSidecar moves the attribute sidecar of an object along with it. Most
+// objects have none, which is not an error.
+func moveSidecar(s3Client *s3.S3, bucketName, from, to string) error {
+	err := moveObject(s3Client, bucketName, xattrSidecarPrefix+from, to, "")
+	if aerr, ok := err.(awserr.RequestFailure); ok && aerr.StatusCode() == 404 {
+		return nil
+	}
+	return err
+}
+
+// trashObject moves key to the trash of runID, along with its attribute
+// sidecar if it has one.
+func trashObject(s3Client *s3.S3, bucketName, runID, key, class string, sidecar bool) error {
+	stored := remoteKey(key)
+	if err := moveObject(s3Client, bucketName, stored, trashKey(runID, stored), class); err != nil {
+		return err
+	}
+	if sidecar {
+		return moveSidecar(s3Client, bucketName, stored, trashKey(runID, xattrSidecarPrefix+stored))
+	}
+	return nil
+}
+
+// trashEntry is an object in the trash.
+type trashEntry struct {
+	RunID    string
+	Key      string
+	Stored   string
+	Size     int64
+	Class    string
+	Modified time.Time
+	Sidecar  bool
+}
+
+// listTrash lists the objects in the trash, optionally of a single run,
+// sorted by run and key. Attribute sidecars are reported on their object.
+func listTrash(s3Client *s3.S3, bucketName, runID string) ([]trashEntry, error) {
+	prefix := trashPrefix
+	if runID != "" {
+		prefix = trashPrefix + runID + "/"
+	}
+
+	var entries []trashEntry
+	sidecars := make(map[string]bool)
+	err := s3Client.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: aws.String(bucketName),
+		Prefix: aws.String(prefix),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, obj := range page.Contents {
+			run, stored, ok := strings.Cut(strings.TrimPrefix(aws.StringValue(obj.Key), trashPrefix), "/")
+			if !ok {
+				continue
+			}
+			if strings.HasPrefix(stored, xattrSidecarPrefix) {
+				sidecars[run+"/"+strings.TrimPrefix(stored, xattrSidecarPrefix)] = true
+				continue
+			}
+			key, ok := listedKey(stored)
+			if !ok {
+				continue
+			}
+			entries = append(entries, trashEntry{
+				RunID:    run,
+				Key:      key,
+				Stored:   stored,
+				Size:     aws.Int64Value(obj.Size),
+				Class:    listedStorageClass(obj),
+				Modified: aws.TimeValue(obj.LastModified),
+			})
+		}
+		return !lastPage
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list trash: %v", err)
+	}
+
+	for i := range entries {
+		entries[i].Sidecar = sidecars[entries[i].RunID+"/"+entries[i].Stored]
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].RunID != entries[j].RunID {
+			return entries[i].RunID < entries[j].RunID
+		}
+		return entries[i].Key < entries[j].Key
+	})
+	return entries, nil
+}
+
+func listTrashCmd(bucketName string) error {
+	if err := loadEncryptionConfig(); err != nil {
+		return err
+	}
+
+	sess, err := newSession()
+	if err != nil {
+		return err
+	}
+
+	entries, err := listTrash(s3.New(sess), bucketName, trashRun)
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		fmt.Println("The trash is empty")
+		return nil
+	}
+
+	runs := 0
+	for i, entry := range entries {
+		if i == 0 || entry.RunID != entries[i-1].RunID {
+			fmt.Printf("Run %s:\n", entry.RunID)
+			runs++
+		}
+		fmt.Printf("  %s (%d bytes, %s)\n", entry.Key, entry.Size, entry.Modified.Format(time.RFC3339))
+	}
+	fmt.Printf("%d object(s) from %d run(s)\n", len(entries), runs)
+	return nil
+}
+
+func restoreTrash(bucketName, runID, prefix string) error {
+	if err := loadSSEConfig(); err != nil {
+		return err
+	}
+
+	if err := loadEncryptionConfig(); err != nil {
+		return err
+	}
+
+	sess, err := newSession()
+	if err != nil {
+		return err
+	}
+
+	s3Client := s3.New(sess)
+
+	entries, err := listTrash(s3Client, bucketName, runID)
+	if err != nil {
+		return err
+	}
+
+	restored, skipped := 0, 0
+	var failed []string
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Key, prefix) {
+			continue
+		}
+
+		if !trashOverwrite {
+			input := &s3.HeadObjectInput{
+				Bucket: aws.String(bucketName),
+				Key:    aws.String(entry.Stored),
+			}
+			_, err := headObject(s3Client, input)
+			if err == nil {
+				fmt.Printf("Skipped (exists, use --overwrite): %s\n", entry.Key)
+				skipped++
+				continue
+			}
+			if aerr, ok := err.(awserr.RequestFailure); !ok || aerr.StatusCode() != 404 {
+				return fmt.Errorf("failed to check object %s: %v", entry.Key, err)
+			}
+		}
+
+		if isArchived(entry.Class) {
+			fmt.Printf("Error: %s is archived in %s and must be restored first\n", entry.Key, entry.Class)
+			failed = append(failed, entry.Key)
+			continue
+		}
+
+		err := moveObject(s3Client, bucketName, trashKey(runID, entry.Stored), entry.Stored, entry.Class)
+		if err != nil {
+			return fmt.Errorf("failed to restore %s: %v", entry.Key, err)
+		}
+		if entry.Sidecar {
+			err := moveObject(s3Client, bucketName, trashKey(runID, xattrSidecarPrefix+entry.Stored), xattrSidecarPrefix+entry.Stored, "")
+			if err != nil {
+				return fmt.Errorf("failed to restore attributes of %s: %v", entry.Key, err)
+			}
+		}
+		fmt.Printf("Restored s3://%s/%s\n", bucketName, entry.Key)
+		restored++
+	}
+
+	fmt.Printf("Restored %d object(s), skipped %d\n", restored, skipped)
+	if len(failed) > 0 {
+		return fmt.Errorf("%d object(s) could not be restored", len(failed))
+	}
+	return nil
+}
+
+func purgeTrash(bucketName string) error {
+	selected := 0
+	for _, set := range []bool{trashRun != "", trashOlderThan != "", trashAll} {
+		if set {
+			selected++
+		}
+	}
+	if selected != 1 {
+		return fmt.Errorf("exactly one of --run, --older-than and --all is required")
+	}
+
+	var cutoff time.Time
+	if trashOlderThan != "" {
+		age, err := time.ParseDuration(trashOlderThan)
+		if err != nil || age <= 0 {
+			return fmt.Errorf("invalid --older-than %q (want a duration such as 720h)", trashOlderThan)
+		}
+		cutoff = time.Now().Add(-age)
+	}
+
+	prefix := trashPrefix
+	if trashRun != "" {
+		prefix = trashPrefix + trashRun + "/"
+	}
+
+	sess, err := newSession()
+	if err != nil {
+		return err
+	}
+
+	s3Client := s3.New(sess)
+
+	// Keys are deleted as stored, so encrypted key names need no key here
+	var keys []string
+	err = s3Client.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: aws.String(bucketName),
+		Prefix: aws.String(prefix),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, obj := range page.Contents {
+			if !cutoff.IsZero() && aws.TimeValue(obj.LastModified).After(cutoff) {
+				continue
+			}
+			keys = append(keys, aws.StringValue(obj.Key))
+		}
+		return !lastPage
+	})
+	if err != nil {
+		return fmt.Errorf("failed to list trash: %v", err)
+	}
+
+	if err := confirmDeletes(keys, "permanently deleted from s3://"+bucketName); err != nil {
+		return err
+	}
+
+	failed, err := deleteObjects(s3Client, bucketName, keys)
+	if err != nil {
+		return fmt.Errorf("failed to delete objects: %v", err)
+	}
+	for key, reason := range failed {
+		fmt.Printf("Error: failed to delete s3://%s/%s: %s\n", bucketName, key, reason)
+	}
+	fmt.Printf("Purged %d object(s) from the trash\n", len(keys)-len(failed))
+	if len(failed) > 0 {
+		return fmt.Errorf("%d object(s) could not be deleted", len(failed))
+	}
+	return nil
+}
@@ -0,0 +1,189 @@
+package cmd
+
+import (
+	"crypto/md5"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeObjectStore is an in-memory bucket named "bucket" that supports
+// listing, get, head, put, copy, ACLs and single and batched deletes. Keys in
+// kmsKeys are encrypted with that KMS key, and keys in public are readable
+// by everyone.
+type fakeObjectStore struct {
+	mu        sync.Mutex
+	versioned bool
+	objects   map[string]string
+	kmsKeys   map[string]string
+	public    map[string]bool
+}
+
+func (s *fakeObjectStore) keys() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := make([]string, 0, len(s.objects))
+	for key := range s.objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (s *fakeObjectStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/bucket"), "/")
+	switch {
+	case r.Method == http.MethodGet && r.URL.Query().Has("versioning"):
+		status := ""
+		if s.versioned {
+			status = "<Status>Enabled</Status>"
+		}
+		w.Write([]byte(`<VersioningConfiguration>` + status + `</VersioningConfiguration>`))
+	case r.Method == http.MethodGet && key == "":
+		prefix := r.URL.Query().Get("prefix")
+		var body strings.Builder
+		body.WriteString(`<ListBucketResult><IsTruncated>false</IsTruncated>`)
+		for k, v := range s.objects {
+			if strings.HasPrefix(k, prefix) {
+				fmt.Fprintf(&body, `<Contents><Key>%s</Key><Size>%d</Size><LastModified>2024-03-01T00:00:00Z</LastModified><ETag>"%x"</ETag></Contents>`, k, len(v), md5.Sum([]byte(v)))
+			}
+		}
+		body.WriteString(`</ListBucketResult>`)
+		w.Write([]byte(body.String()))
+	case r.Method == http.MethodGet && !r.URL.Query().Has("acl"):
+		value, ok := s.objects[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`<Error><Code>NoSuchKey</Code></Error>`))
+			return
+		}
+		w.Write([]byte(value))
+	case r.Method == http.MethodHead:
+		if _, ok := s.objects[key]; !ok && key != "" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if kmsKey, ok := s.kmsKeys[key]; ok {
+			w.Header().Set("X-Amz-Server-Side-Encryption", "aws:kms")
+			w.Header().Set("X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id", kmsKey)
+		}
+	case r.Method == http.MethodGet && r.URL.Query().Has("acl"):
+		grants := `<Grant><Grantee xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance" xsi:type="CanonicalUser"><ID>owner</ID></Grantee><Permission>FULL_CONTROL</Permission></Grant>`
+		if s.public[key] {
+			grants += `<Grant><Grantee xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance" xsi:type="Group"><URI>http://acs.amazonaws.com/groups/global/AllUsers</URI></Grantee><Permission>READ</Permission></Grant>`
+		}
+		w.Write([]byte(`<AccessControlPolicy><Owner><ID>owner</ID></Owner><AccessControlList>` + grants + `</AccessControlList></AccessControlPolicy>`))
+	case r.Method == http.MethodPut && r.URL.Query().Has("acl"):
+		body, _ := io.ReadAll(r.Body)
+		if s.public == nil {
+			s.public = make(map[string]bool)
+		}
+		s.public[key] = strings.Contains(string(body), "AllUsers")
+	case r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source") != "":
+		source, _ := url.PathUnescape(strings.TrimPrefix(r.Header.Get("X-Amz-Copy-Source"), "bucket/"))
+		value, ok := s.objects[source]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`<Error><Code>NoSuchKey</Code></Error>`))
+			return
+		}
+		s.objects[key] = value
+		if kmsKey := r.Header.Get("X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id"); kmsKey != "" {
+			if s.kmsKeys == nil {
+				s.kmsKeys = make(map[string]string)
+			}
+			s.kmsKeys[key] = kmsKey
+		}
+		w.Write([]byte(`<CopyObjectResult><ETag>"x"</ETag></CopyObjectResult>`))
+	case r.Method == http.MethodPut:
+		body, _ := io.ReadAll(r.Body)
+		s.objects[key] = string(body)
+	case r.Method == http.MethodPost && r.URL.Query().Has("delete"):
+		var request struct {
+			Objects []struct{ Key string } `xml:"Object"`
+		}
+		if err := xml.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for _, object := range request.Objects {
+			delete(s.objects, object.Key)
+		}
+		w.Write([]byte(`<DeleteResult></DeleteResult>`))
+	case r.Method == http.MethodDelete:
+		delete(s.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "unexpected request "+r.Method+" "+r.URL.String(), http.StatusBadRequest)
+	}
+}
+
+func TestTrashRoundTrip(t *testing.T) {
+	defer func() {
+		trashOverwrite, trashRun, trashAll, assumeYes = false, "", false, false
+	}()
+
+	store := &fakeObjectStore{objects: map[string]string{
+		"docs/a.txt":                "a",
+		"b.txt":                     "b",
+		".s3sync/xattrs/docs/a.txt": "attrs",
+	}, kmsKeys: map[string]string{"docs/a.txt": "key-1"}, public: map[string]bool{"docs/a.txt": true}}
+	useFakeEndpoint(t, store)
+	client := newFakeS3Client(t, store.ServeHTTP)
+
+	for _, key := range []string{"docs/a.txt", "b.txt"} {
+		if err := trashObject(client, "bucket", "run-1", key, "", key == "docs/a.txt"); err != nil {
+			t.Fatalf("trashObject(%s) failed: %v", key, err)
+		}
+	}
+	want := []string{".trash/run-1/.s3sync/xattrs/docs/a.txt", ".trash/run-1/b.txt", ".trash/run-1/docs/a.txt"}
+	if got := store.keys(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Unexpected keys after trashing %v, want %v", got, want)
+	}
+
+	entries, err := listTrash(client, "bucket", "")
+	if err != nil {
+		t.Fatalf("listTrash failed: %v", err)
+	}
+	if len(entries) != 2 || entries[0].Key != "b.txt" || entries[1].Key != "docs/a.txt" || !entries[1].Sidecar || entries[0].Sidecar {
+		t.Fatalf("Unexpected trash entries %+v", entries)
+	}
+
+	// A key that was uploaded again is left alone without --overwrite
+	store.objects["b.txt"] = "new"
+	if err := restoreTrash("bucket", "run-1", ""); err != nil {
+		t.Fatalf("restoreTrash failed: %v", err)
+	}
+	want = []string{".s3sync/xattrs/docs/a.txt", ".trash/run-1/b.txt", "b.txt", "docs/a.txt"}
+	if got := store.keys(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Unexpected keys after restoring %v, want %v", got, want)
+	}
+	if store.objects["b.txt"] != "new" {
+		t.Errorf("Expected b.txt not to be overwritten")
+	}
+	if store.kmsKeys["docs/a.txt"] != "key-1" || !store.public["docs/a.txt"] {
+		t.Errorf("Expected docs/a.txt to keep its encryption and ACL")
+	}
+
+	if err := purgeTrash("bucket"); err == nil {
+		t.Errorf("Expected purge without a selection to be rejected")
+	}
+	trashRun, assumeYes = "run-1", true
+	if err := purgeTrash("bucket"); err != nil {
+		t.Fatalf("purgeTrash failed: %v", err)
+	}
+	want = []string{".s3sync/xattrs/docs/a.txt", "b.txt", "docs/a.txt"}
+	if got := store.keys(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected keys after purging %v, want %v", got, want)
+	}
+}
@@ -2,13 +2,14 @@ package cmd
 
 import (
     "fmt"
+    "io"
     "os"
     "path/filepath"
+    "sort"
     "strings"
+    "time"
 
     "github.com/aws/aws-sdk-go/aws"
-    "github.com/aws/aws-sdk-go/aws/credentials"
-    "github.com/aws/aws-sdk-go/aws/session"
     "github.com/aws/aws-sdk-go/service/s3"
     "github.com/spf13/cobra"
 )
@@ -16,8 +17,9 @@ import (
 
 
 var uploadCmd = &cobra.Command{
-    Use:   "upload",
-    Short: "Sync directory to S3 by comparing checksums",
+    Use:     "upload",
+    Short:   "Sync directory to S3 by comparing checksums",
+    PreRunE: requireFlags("input", "bucket"),
     RunE: func(cmd *cobra.Command, args []string) error {
         return uploadToS3(inputDir, bucketName)
     },
@@ -26,78 +28,118 @@ var uploadCmd = &cobra.Command{
 func init() {
     rootCmd.AddCommand(uploadCmd)
     uploadCmd.Flags().StringVarP(&inputDir, "input", "i", "", "Input directory path")
-    uploadCmd.Flags().StringVarP(&bucketName, "bucket", "b", "", "S3 bucket name")
-    uploadCmd.Flags().StringVarP(&endpointURL, "endpoint", "e", "", "AWS Endpoint URL (for testing with LocalStack)")
-    uploadCmd.Flags().StringVarP(&region, "region", "r", "us-east-1", "AWS Region")
-    uploadCmd.Flags().BoolVarP(&deleteExtra, "delete", "d", false, "Delete files in S3 that are not present in the local directory")
-    uploadCmd.MarkFlagRequired("input")
-    uploadCmd.MarkFlagRequired("bucket")
+    uploadCmd.Flags().StringVar(&sseMode, "sse", "", "Server-side encryption: AES256, aws:kms or aws:kms:dsse")
+    uploadCmd.Flags().StringVar(&sseKMSKeyID, "sse-kms-key-id", "", "KMS key ID or ARN to use with --sse aws:kms")
+    uploadCmd.Flags().BoolVar(&encryptContent, "encrypt", false, "Encrypt file contents client-side with AES-256-GCM before upload")
+    uploadCmd.Flags().StringVar(&compressCodec, "compress", "", "Compress uploaded files with gzip or zstd")
+    uploadCmd.Flags().StringArrayVar(&compressPatterns, "compress-pattern", nil, "Only compress keys matching this glob pattern (repeatable)")
+    uploadCmd.Flags().StringVar(&storageClass, "storage-class", "", "Storage class for uploaded objects, e.g. STANDARD_IA or GLACIER_IR")
+    uploadCmd.Flags().StringArrayVar(&storageClassRules, "storage-class-rule", nil, "Storage class for keys matching a pattern, as pattern=CLASS (repeatable)")
+    uploadCmd.Flags().StringVar(&cannedACL, "acl", "", "Canned ACL for uploaded objects, e.g. bucket-owner-full-control or public-read")
+    uploadCmd.Flags().StringVar(&grantRead, "grant-read", "", "Grantees allowed to read uploaded objects, e.g. id=<canonical user id>")
+    uploadCmd.Flags().StringVar(&grantReadACP, "grant-read-acp", "", "Grantees allowed to read the ACL of uploaded objects")
+    uploadCmd.Flags().StringVar(&grantWriteACP, "grant-write-acp", "", "Grantees allowed to change the ACL of uploaded objects")
+    uploadCmd.Flags().StringVar(&grantFullControl, "grant-full-control", "", "Grantees given full control of uploaded objects")
+    uploadCmd.Flags().StringArrayVar(&objectTags, "tag", nil, "Tag to set on uploaded objects, as key=value (repeatable)")
+    uploadCmd.Flags().StringVar(&tagRulesFile, "tag-rules", "", "YAML file mapping key patterns to tags for uploaded objects")
+    uploadCmd.Flags().StringVar(&headerRulesFile, "header-rules", "", "YAML file mapping key patterns to HTTP headers for uploaded objects")
+    uploadCmd.Flags().StringVar(&notifySQSQueueURL, "notify-sqs-queue-url", "", "SQS queue URL to send a change event to after the sync")
+    uploadCmd.Flags().StringVar(&notifySNSTopicARN, "notify-sns-topic-arn", "", "SNS topic ARN to publish a change event to after the sync")
+    uploadCmd.Flags().StringVar(&notifyWebhookURL, "notify-webhook-url", "", "HTTP endpoint to POST a JSON change event to after the sync")
+    uploadCmd.Flags().IntVar(&notifyRetries, "notify-retries", 3, "Number of times to retry a failed change event delivery")
+    uploadCmd.Flags().StringVar(&notifyEndpointURL, "notify-endpoint", "", "Custom SQS/SNS endpoint URL used for change events")
 }
 
 func uploadToS3(inputDir, bucketName string) error {
-    config := &aws.Config{
-        Region: aws.String(region),
+    startedAt := time.Now()
+
+    rules, err := loadHeaderRules(headerRulesFile)
+    if err != nil {
+        return err
     }
 
-    if endpointURL != "" {
-        config.Endpoint = aws.String(endpointURL)
-        config.S3ForcePathStyle = aws.Bool(true)
-        // Set static credentials for LocalStack
-        config.Credentials = credentials.NewStaticCredentials("test", "test", "")
+    if err := loadSSEConfig(); err != nil {
+        return err
     }
 
-    sess, err := session.NewSession(config)
-    if err != nil {
-        return fmt.Errorf("failed to create AWS session: %v", err)
+    if err := loadEncryptionConfig(); err != nil {
+        return err
     }
 
-    s3Client := s3.New(sess)
+    if err := loadCompressionConfig(); err != nil {
+        return err
+    }
 
-    // Ensure the bucket exists
-    _, err = s3Client.HeadBucket(&s3.HeadBucketInput{
-        Bucket: aws.String(bucketName),
-    })
+    if err := loadStorageClassConfig(); err != nil {
+        return err
+    }
+
+    if err := validateACLOptions(); err != nil {
+        return err
+    }
+
+    if err := loadTagConfig(); err != nil {
+        return err
+    }
+
+    if err := validateDeleteMode(); err != nil {
+        return err
+    }
+
+    if err := validateBucketOptions(); err != nil {
+        return err
+    }
+
+    limit, err := loadDeleteLimit()
     if err != nil {
-        // Try to create the bucket
-        _, err = s3Client.CreateBucket(&s3.CreateBucketInput{
-            Bucket: aws.String(bucketName),
-        })
-        if err != nil {
-            return fmt.Errorf("failed to create bucket: %v", err)
-        }
+        return err
     }
 
-    // Map to store local files and their checksums
-    localFiles := make(map[string]string)
+    sess, err := newSession()
+    if err != nil {
+        return err
+    }
 
-    // Walk through the local directory and compute checksums
-    err = filepath.Walk(inputDir, func(path string, info os.FileInfo, err error) error {
-        if err != nil {
-            return err
-        }
+    s3Client := s3.New(sess)
 
-        if !info.IsDir() {
-            relativePath, err := filepath.Rel(inputDir, path)
-            if err != nil {
-                return err
-            }
+    // Ensure the bucket exists, creating it only if asked to
+    if err := ensureBucket(s3Client, bucketName); err != nil {
+        return err
+    }
 
-            checksum, err := computeMD5Checksum(path)
-            if err != nil {
-                return err
-            }
+    // Fail before uploading anything if the bucket rejects ACLs
+    if err := checkBucketACLs(s3Client, bucketName); err != nil {
+        return err
+    }
 
-            localFiles[relativePath] = checksum
-        }
+    // Walk through the local directory and compute checksums
+    localFiles, err := scanLocalFiles(inputDir)
+    if err != nil {
+        return err
+    }
 
-        return nil
-    })
+    // Index local files by the object key they are stored under
+    localByKey, err := indexLocalFiles(localFiles)
     if err != nil {
         return err
     }
 
-    // Map to store S3 objects and their ETags
+    // Files whose keys S3 would reject are left out before changing anything
+    var tooLong []string
+    for s3Key, local := range localByKey {
+        if err := checkKeyLength(s3Key); err != nil {
+            fmt.Printf("Skipped (%v): %s\n", err, local.Path)
+            tooLong = append(tooLong, local.Path)
+            delete(localByKey, s3Key)
+        }
+    }
+    sort.Strings(tooLong)
+
+    // Map to store S3 objects and their ETags, and their storage classes
     s3Objects := make(map[string]string)
+    s3Classes := make(map[string]string)
+    // Stored keys of objects with an attribute sidecar
+    sidecars := make(map[string]bool)
 
     // List objects in the S3 bucket
     err = s3Client.ListObjectsV2Pages(&s3.ListObjectsV2Input{
@@ -105,8 +147,19 @@ func uploadToS3(inputDir, bucketName string) error {
     }, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
         for _, obj := range page.Contents {
             key := *obj.Key
+            if strings.HasPrefix(key, xattrSidecarPrefix) {
+                sidecars[strings.TrimPrefix(key, xattrSidecarPrefix)] = true
+            }
+            if isInternalKey(key) {
+                continue
+            }
+            key, ok := listedKey(key)
+            if !ok {
+                continue
+            }
             etag := strings.Trim(*obj.ETag, "\"") // Remove quotes from ETag
             s3Objects[key] = etag
+            s3Classes[key] = listedStorageClass(obj)
         }
         return !lastPage
     })
@@ -114,53 +167,246 @@ func uploadToS3(inputDir, bucketName string) error {
         return fmt.Errorf("failed to list objects in bucket: %v", err)
     }
 
+    // Decide what --delete removes before changing anything
+    var toDelete []string
+    if deleteExtra {
+        for s3Key := range s3Objects {
+            if _, exists := localByKey[s3Key]; !exists {
+                toDelete = append(toDelete, s3Key)
+            }
+        }
+        sort.Strings(toDelete)
+        if err := limit.check(len(toDelete), len(s3Objects)); err != nil {
+            return err
+        }
+
+        action := "deleted from s3://" + bucketName
+        if deleteMode == deleteModeTrash {
+            action = "moved to s3://" + bucketName + "/" + trashPrefix
+        }
+        if err := confirmDeletes(toDelete, action); err != nil {
+            return err
+        }
+    }
+
+    event := &syncEvent{
+        RunID:     newRunID(startedAt),
+        Operation: "upload",
+        Bucket:    bucketName,
+        Uploaded:  []string{},
+        Deleted:   []string{},
+        StartedAt: startedAt,
+    }
+    event.Totals.Scanned = len(localFiles)
+    event.Totals.Skipped = len(tooLong)
+
     // Upload new or updated files
-    for relativePath, localChecksum := range localFiles {
-        s3Checksum, exists := s3Objects[relativePath]
-        if !exists || localChecksum != s3Checksum {
+    for s3Key, local := range localByKey {
+        s3Checksum, exists := s3Objects[s3Key]
+        unchanged := false
+        if exists {
+            unchanged, err = sameContent(s3Client, bucketName, s3Key, s3Checksum, local.Checksum)
+            if err != nil {
+                return fmt.Errorf("failed to check object %s: %v", s3Key, err)
+            }
+        }
+        if !unchanged {
             // File is new or has changed, upload it
-            err := uploadFile(s3Client, bucketName, inputDir, relativePath)
+            err := uploadFile(s3Client, bucketName, inputDir, local, s3Key, rules, sidecars[remoteKey(s3Key)])
             if err != nil {
                 return err
             }
-            fmt.Printf("Uploaded %s to s3://%s/%s\n", relativePath, bucketName, relativePath)
+            fmt.Printf("Uploaded %s to s3://%s/%s\n", local.Path, bucketName, s3Key)
+            event.Uploaded = append(event.Uploaded, remoteKey(s3Key))
+            if info, err := os.Stat(filepath.Join(inputDir, local.Path)); err == nil {
+                event.Totals.BytesUploaded += info.Size()
+            }
+        } else if class := storageClassFor(s3Key); class != "" && class != s3Classes[s3Key] {
+            // Only the storage class differs, so copy the object in place
+            if isArchived(s3Classes[s3Key]) {
+                fmt.Printf("Skipped (archived in %s, cannot transition without a restore): %s\n", s3Classes[s3Key], local.Path)
+                event.Totals.Skipped++
+                continue
+            }
+            err := transitionObject(s3Client, bucketName, s3Key, class)
+            if err != nil {
+                return fmt.Errorf("failed to transition object %s to %s: %v", s3Key, class, err)
+            }
+            fmt.Printf("Transitioned s3://%s/%s from %s to %s\n", bucketName, s3Key, s3Classes[s3Key], class)
+            event.Totals.Transitioned++
         } else {
-            fmt.Printf("Skipped (unchanged): %s\n", relativePath)
+            fmt.Printf("Skipped (unchanged): %s\n", local.Path)
+            event.Totals.Skipped++
         }
     }
 
     // Optionally delete files in S3 that are not in local directory
-    if deleteExtra {
-        for s3Key := range s3Objects {
-            if _, exists := localFiles[s3Key]; !exists {
-                // Delete the object from S3
-                _, err := s3Client.DeleteObject(&s3.DeleteObjectInput{
-                    Bucket: aws.String(bucketName),
-                    Key:    aws.String(s3Key),
-                })
-                if err != nil {
-                    return fmt.Errorf("failed to delete object %s: %v", s3Key, err)
-                }
-                fmt.Printf("Deleted s3://%s/%s\n", bucketName, s3Key)
+    failedDeletes := 0
+    if deleteMode == deleteModeTrash {
+        for _, s3Key := range toDelete {
+            // Move the object aside so that it can be restored
+            if isArchived(s3Classes[s3Key]) {
+                fmt.Printf("Skipped (archived in %s, cannot move to the trash without a restore): %s\n", s3Classes[s3Key], s3Key)
+                continue
+            }
+            err := trashObject(s3Client, bucketName, event.RunID, s3Key, s3Classes[s3Key], sidecars[remoteKey(s3Key)])
+            if err != nil {
+                return fmt.Errorf("failed to move object %s to the trash: %v", s3Key, err)
+            }
+            fmt.Printf("Moved s3://%s/%s to s3://%s/%s\n", bucketName, s3Key, bucketName, trashKey(event.RunID, s3Key))
+            event.Deleted = append(event.Deleted, remoteKey(s3Key))
+        }
+    } else if len(toDelete) > 0 {
+        keys := make([]string, 0, len(toDelete))
+        for _, s3Key := range toDelete {
+            keys = append(keys, remoteKey(s3Key))
+            if sidecars[remoteKey(s3Key)] {
+                // Remove the attribute sidecar along with the object
+                keys = append(keys, xattrSidecarPrefix+remoteKey(s3Key))
+            }
+        }
+        failed, err := deleteObjects(s3Client, bucketName, keys)
+        if err != nil {
+            return fmt.Errorf("failed to delete objects: %v", err)
+        }
+        for _, s3Key := range toDelete {
+            if reason, ok := failed[remoteKey(s3Key)]; ok {
+                fmt.Printf("Error: failed to delete s3://%s/%s: %s\n", bucketName, s3Key, reason)
+                failedDeletes++
+                continue
             }
+            fmt.Printf("Deleted s3://%s/%s\n", bucketName, s3Key)
+            event.Deleted = append(event.Deleted, remoteKey(s3Key))
+        }
+    }
+
+    event.Totals.Uploaded = len(event.Uploaded)
+    event.Totals.Deleted = len(event.Deleted)
+    event.FinishedAt = time.Now()
+
+    // Record runs that changed a versioned bucket so they can be rolled
+    // back by ID
+    if len(event.Uploaded) > 0 || len(event.Deleted) > 0 {
+        versioned, err := bucketVersioned(s3Client, bucketName)
+        if err == nil && versioned {
+            err = recordRun(s3Client, bucketName, event)
+        }
+        if err != nil {
+            fmt.Printf("Warning: failed to record run %s: %v\n", event.RunID, err)
+        } else if versioned {
+            fmt.Printf("Run ID: %s\n", event.RunID)
+        }
+    }
+    if deleteMode == deleteModeTrash && len(event.Deleted) > 0 {
+        fmt.Printf("Removed objects can be restored with: trash restore --run %s\n", event.RunID)
+    }
+
+    if notificationsEnabled() {
+        if err := publishSyncEvent(sess, event); err != nil {
+            return err
         }
+        fmt.Printf("Published change event for run %s\n", event.RunID)
+    }
+
+    if failedDeletes > 0 {
+        return fmt.Errorf("%d object(s) could not be deleted", failedDeletes)
+    }
+
+    if len(tooLong) > 0 {
+        return fmt.Errorf("%d file(s) were not uploaded because their keys are too long: %s", len(tooLong), strings.Join(tooLong, ", "))
     }
 
     return nil
 }
 
-func uploadFile(s3Client *s3.S3, bucketName, inputDir, relativePath string) error {
-    filePath := filepath.Join(inputDir, relativePath)
+// uploadFile uploads one local file to s3Key. oldSidecar reports whether the
+// object being replaced has an attribute sidecar, which is removed unless the
+// new object uses it too.
+func uploadFile(s3Client *s3.S3, bucketName, inputDir string, local localEntry, s3Key string, rules []headerRule, oldSidecar bool) error {
+    if isDirMarker(s3Key) {
+        return uploadDirMarker(s3Client, bucketName, s3Key)
+    }
+
+    filePath := filepath.Join(inputDir, local.Path)
+    if symlinkPolicy == symlinksPreserve {
+        if info, err := os.Lstat(filePath); err == nil && info.Mode()&os.ModeSymlink != 0 {
+            if err := uploadSymlink(s3Client, bucketName, s3Key, filePath); err != nil {
+                return err
+            }
+            if oldSidecar {
+                return removeSidecar(s3Client, bucketName, remoteKey(s3Key))
+            }
+            return nil
+        }
+    }
+
     file, err := os.Open(filePath)
     if err != nil {
         return err
     }
     defer file.Close()
 
-    _, err = s3Client.PutObject(&s3.PutObjectInput{
-        Bucket: aws.String(bucketName),
-        Key:    aws.String(relativePath),
-        Body:   file,
-    })
-    return err
+    info, err := file.Stat()
+    if err != nil {
+        return err
+    }
+
+    input := &s3.PutObjectInput{
+        Bucket:   aws.String(bucketName),
+        Key:      aws.String(remoteKey(s3Key)),
+        Body:     file,
+        Metadata: fileMetadata(info),
+    }
+    // Transformed bodies are spooled to temporary files so they stay seekable
+    var body io.Reader = file
+    codec := compressionFor(s3Key)
+    if codec != "" {
+        compressed, err := spoolTemp(func(w io.Writer) error {
+            return compressStream(w, body, codec)
+        })
+        if err != nil {
+            return fmt.Errorf("failed to compress %s: %v", filePath, err)
+        }
+        defer removeTemp(compressed)
+        input.Body = compressed
+        body = compressed
+        input.Metadata[metaCompression] = aws.String(codec)
+    }
+    if encryptContent {
+        encrypted, err := spoolTemp(func(w io.Writer) error {
+            return encryptStream(w, body, input.Metadata, local.Checksum)
+        })
+        if err != nil {
+            return fmt.Errorf("failed to encrypt %s: %v", filePath, err)
+        }
+        defer removeTemp(encrypted)
+        input.Body = encrypted
+    } else {
+        input.Metadata[metaMD5] = aws.String(local.Checksum)
+        if codec != "" {
+            input.ContentEncoding = aws.String(codec)
+        }
+    }
+    applySSE(input)
+    applyACL(input)
+    applyStorageClass(input, s3Key)
+    if err := applyTags(input, s3Key); err != nil {
+        return err
+    }
+    if err := applyHeaders(input, rules, s3Key, filePath); err != nil {
+        return err
+    }
+    if preserveXattrs {
+        if err := attachXattrs(s3Client, input, filePath); err != nil {
+            return err
+        }
+    }
+
+    if _, err = s3Client.PutObject(input); err != nil {
+        return err
+    }
+    if oldSidecar && aws.StringValue(input.Metadata[metaXattrs]) != xattrSidecarValue {
+        return removeSidecar(s3Client, bucketName, *input.Key)
+    }
+    return nil
 }
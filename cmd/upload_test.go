@@ -16,7 +16,9 @@ import (
     "github.com/testcontainers/testcontainers-go/wait"
 )
 
-func TestuploadToS3(t *testing.T) {
+func TestUploadToS3(t *testing.T) {
+    testcontainers.SkipIfProviderIsNotHealthy(t)
+
     ctx := context.Background()
 
     req := testcontainers.ContainerRequest{
@@ -54,6 +56,8 @@ func TestuploadToS3(t *testing.T) {
     // Set the endpointURL for the sync function
     endpointURL = endpoint
     region = "us-east-1"
+    accessKeyID = "test"
+    secretAccessKey = "test"
 
     // Create a temporary directory with some files
     tempDir, err := ioutil.TempDir("", "testsync")
@@ -71,6 +75,8 @@ func TestuploadToS3(t *testing.T) {
     inputDir = tempDir
     bucketName = "test-bucket"
     deleteExtra = false
+    createBucket = true
+    defer func() { createBucket = false }()
 
     // Run the sync function (initial upload)
     err = uploadToS3(inputDir, bucketName)
@@ -137,6 +143,8 @@ func TestuploadToS3(t *testing.T) {
 
     // Now run sync with deletion of extra files
     deleteExtra = true
+    assumeYes = true
+    defer func() { assumeYes = false }()
     err = uploadToS3(inputDir, bucketName)
     if err != nil {
         t.Fatalf("uploadToS3 with deleteExtra failed: %v", err)
@@ -5,8 +5,14 @@ import (
     "encoding/hex"
     "io"
     "os"
+    "strings"
 )
 
+// internalPrefix holds objects written by s3sync itself. They are never
+// synced, reported as changes or removed by --delete, and neither is the
+// trash.
+const internalPrefix = ".s3sync/"
+
 var (
     inputDir       string
 	outputDir    string
@@ -31,3 +37,7 @@ func computeMD5Checksum(filePath string) (string, error) {
     checksum := hex.EncodeToString(hash.Sum(nil))
     return checksum, nil
 }
+
+func isInternalKey(key string) bool {
+    return strings.HasPrefix(key, internalPrefix) || strings.HasPrefix(key, trashPrefix)
+}
@@ -0,0 +1,120 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+var asOfTimestamp string
+
+// pinnedVersions maps keys to the version a point-in-time download reads.
+// It is only set for the duration of downloadToLocal with --as-of.
+var pinnedVersions map[string]string
+
+// parseAsOf accepts an RFC 3339 timestamp, a date and time without zone
+// (UTC), a date (midnight UTC), or a duration meaning that long ago.
+func parseAsOf(value string, now time.Time) (time.Time, error) {
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04:05", "2006-01-02 15:04:05", "2006-01-02"} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+	if d, err := time.ParseDuration(value); err == nil && d > 0 {
+		return now.Add(-d), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid --as-of %q (want an RFC 3339 timestamp, a date or a duration such as 24h)", value)
+}
+
+// objectVersion returns the version to read for key, or nil for the current
+// one.
+func objectVersion(key string) *string {
+	if version, ok := pinnedVersions[key]; ok {
+		return aws.String(version)
+	}
+	return nil
+}
+
+// listVersionsAsOf lists the keys under prefix as they were at asOf: for
+// every key, the newest version or delete marker at or before that time wins,
+// and keys whose winner is a delete marker are left out. It returns the
+// ETags, storage classes and version IDs of the remaining keys. A zero asOf
+// lists the current versions.
+func listVersionsAsOf(s3Client *s3.S3, bucketName, prefix string, asOf time.Time) (map[string]string, map[string]string, map[string]string, error) {
+	type candidate struct {
+		modified time.Time
+		deleted  bool
+		etag     string
+		class    string
+		version  string
+		isLatest bool
+	}
+	latest := make(map[string]candidate)
+	consider := func(storedKey string, c candidate) {
+		if isInternalKey(storedKey) || (!asOf.IsZero() && c.modified.After(asOf)) {
+			return
+		}
+		key, ok := listedKey(storedKey)
+		if !ok || !strings.HasPrefix(key, prefix) {
+			return
+		}
+		// Versions are listed newest first, but delete markers separately,
+		// so ties within the same second go to the current version
+		current, seen := latest[key]
+		if !seen || c.modified.After(current.modified) || (c.modified.Equal(current.modified) && c.isLatest) {
+			latest[key] = c
+		}
+	}
+
+	// Encrypted key names can only be matched against the prefix once
+	// decrypted
+	input := &s3.ListObjectVersionsInput{
+		Bucket: aws.String(bucketName),
+	}
+	if !encryptKeys && prefix != "" {
+		input.Prefix = aws.String(prefix)
+	}
+
+	err := s3Client.ListObjectVersionsPages(input, func(page *s3.ListObjectVersionsOutput, lastPage bool) bool {
+		for _, v := range page.Versions {
+			class := s3.StorageClassStandard
+			if v.StorageClass != nil && *v.StorageClass != "" {
+				class = *v.StorageClass
+			}
+			consider(aws.StringValue(v.Key), candidate{
+				modified: aws.TimeValue(v.LastModified),
+				etag:     strings.Trim(aws.StringValue(v.ETag), "\""),
+				class:    class,
+				version:  aws.StringValue(v.VersionId),
+				isLatest: aws.BoolValue(v.IsLatest),
+			})
+		}
+		for _, marker := range page.DeleteMarkers {
+			consider(aws.StringValue(marker.Key), candidate{
+				modified: aws.TimeValue(marker.LastModified),
+				deleted:  true,
+				isLatest: aws.BoolValue(marker.IsLatest),
+			})
+		}
+		return !lastPage
+	})
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to list object versions in bucket: %v", err)
+	}
+
+	objects := make(map[string]string)
+	classes := make(map[string]string)
+	versions := make(map[string]string)
+	for key, c := range latest {
+		if c.deleted {
+			continue
+		}
+		objects[key] = c.etag
+		classes[key] = c.class
+		versions[key] = c.version
+	}
+	return objects, classes, versions, nil
+}
@@ -0,0 +1,68 @@
+package cmd
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestParseAsOf(t *testing.T) {
+	now := time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)
+	tests := map[string]time.Time{
+		"2024-03-09T08:30:00Z":      time.Date(2024, 3, 9, 8, 30, 0, 0, time.UTC),
+		"2024-03-09T08:30:00+01:00": time.Date(2024, 3, 9, 7, 30, 0, 0, time.UTC),
+		"2024-03-09T08:30:00":       time.Date(2024, 3, 9, 8, 30, 0, 0, time.UTC),
+		"2024-03-09":                time.Date(2024, 3, 9, 0, 0, 0, 0, time.UTC),
+		"24h":                       time.Date(2024, 3, 9, 12, 0, 0, 0, time.UTC),
+	}
+	for value, want := range tests {
+		got, err := parseAsOf(value, now)
+		if err != nil || !got.Equal(want) {
+			t.Errorf("parseAsOf(%q) = %v, %v; want %v", value, got, err, want)
+		}
+	}
+	for _, invalid := range []string{"yesterday", "-24h", "2024-13-01"} {
+		if _, err := parseAsOf(invalid, now); err == nil {
+			t.Errorf("Expected %q to be rejected", invalid)
+		}
+	}
+}
+
+func TestListVersionsAsOf(t *testing.T) {
+	client := newFakeS3Client(t, func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := r.URL.Query()["versions"]; !ok {
+			t.Errorf("Unexpected request %s %s", r.Method, r.URL)
+		}
+		w.Write([]byte(`<ListVersionsResult>
+  <IsTruncated>false</IsTruncated>
+  <Version><Key>a.txt</Key><VersionId>a3</VersionId><LastModified>2024-03-10T09:00:00Z</LastModified><ETag>"a3etag"</ETag></Version>
+  <Version><Key>a.txt</Key><VersionId>a2</VersionId><LastModified>2024-03-08T09:00:00Z</LastModified><ETag>"a2etag"</ETag><StorageClass>GLACIER</StorageClass></Version>
+  <Version><Key>a.txt</Key><VersionId>a1</VersionId><LastModified>2024-03-01T09:00:00Z</LastModified><ETag>"a1etag"</ETag></Version>
+  <Version><Key>deleted.txt</Key><VersionId>d1</VersionId><LastModified>2024-03-01T09:00:00Z</LastModified><ETag>"d1etag"</ETag></Version>
+  <Version><Key>later.txt</Key><VersionId>l1</VersionId><LastModified>2024-03-01T09:00:00Z</LastModified><ETag>"l1etag"</ETag></Version>
+  <Version><Key>new.txt</Key><VersionId>n1</VersionId><LastModified>2024-03-10T09:00:00Z</LastModified><ETag>"n1etag"</ETag></Version>
+  <Version><Key>.s3sync/runs/x.json</Key><VersionId>i1</VersionId><LastModified>2024-03-01T09:00:00Z</LastModified><ETag>"i1etag"</ETag></Version>
+  <DeleteMarker><Key>deleted.txt</Key><VersionId>d2</VersionId><LastModified>2024-03-05T09:00:00Z</LastModified></DeleteMarker>
+  <DeleteMarker><Key>later.txt</Key><VersionId>l2</VersionId><LastModified>2024-03-10T09:00:00Z</LastModified></DeleteMarker>
+</ListVersionsResult>`))
+	})
+
+	asOf := time.Date(2024, 3, 9, 0, 0, 0, 0, time.UTC)
+	objects, classes, versions, err := listVersionsAsOf(client, "bucket", "", asOf)
+	if err != nil {
+		t.Fatalf("listVersionsAsOf failed: %v", err)
+	}
+
+	want := map[string]string{"a.txt": "a2", "later.txt": "l1"}
+	if len(versions) != len(want) {
+		t.Errorf("Unexpected versions %v, want %v", versions, want)
+	}
+	for key, version := range want {
+		if versions[key] != version || objects[key] != version+"etag" {
+			t.Errorf("Expected %s at version %s, got %q (%q)", key, version, versions[key], objects[key])
+		}
+	}
+	if classes["a.txt"] != "GLACIER" || classes["later.txt"] != "STANDARD" {
+		t.Errorf("Unexpected storage classes %v", classes)
+	}
+}
@@ -0,0 +1,150 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const (
+	metaXattrs = "s3sync-xattrs"
+
+	// xattrSidecarValue marks an object whose attributes did not fit in its
+	// user metadata and were written to a sidecar object instead.
+	xattrSidecarValue = "sidecar"
+
+	// S3 allows 2 KB of user metadata per object, shared with the other
+	// s3sync keys, so larger attribute sets go to a sidecar.
+	xattrInlineLimit = 1024
+
+	// Linux caps a single attribute value at 64 KiB; anything larger cannot
+	// be restored and is skipped.
+	xattrValueLimit = 64 * 1024
+
+	xattrSidecarPrefix = internalPrefix + "xattrs/"
+)
+
+var preserveXattrs bool
+
+var errXattrsUnsupported = errors.New("extended attributes are not supported on this platform")
+
+// attachXattrs records the extended attributes (including POSIX ACLs, which
+// Linux exposes as system.posix_acl_* attributes) of filePath on an upload
+// request. Attribute sets too large for user metadata are written to a
+// sidecar object under .s3sync/xattrs/.
+func attachXattrs(s3Client *s3.S3, input *s3.PutObjectInput, filePath string) error {
+	attrs, err := readXattrs(filePath)
+	if err != nil {
+		return fmt.Errorf("failed to read extended attributes of %s: %v", filePath, err)
+	}
+
+	for name, value := range attrs {
+		if len(value) > xattrValueLimit {
+			fmt.Printf("Warning: skipping extended attribute %s on %s (%d bytes exceeds limit)\n", name, filePath, len(value))
+			delete(attrs, name)
+		}
+	}
+	if len(attrs) == 0 {
+		return nil
+	}
+
+	encoded, err := json.Marshal(attrs)
+	if err != nil {
+		return err
+	}
+
+	inline := base64.StdEncoding.EncodeToString(encoded)
+	if len(inline) <= xattrInlineLimit {
+		input.Metadata[metaXattrs] = aws.String(inline)
+		return nil
+	}
+
+	sidecar := &s3.PutObjectInput{
+		Bucket:      input.Bucket,
+		Key:         aws.String(xattrSidecarPrefix + *input.Key),
+		Body:        bytes.NewReader(encoded),
+		ContentType: aws.String("application/json"),
+	}
+	applySSE(sidecar)
+	applySidecarACL(sidecar)
+
+	if _, err := s3Client.PutObject(sidecar); err != nil {
+		return fmt.Errorf("failed to upload extended attributes for %s: %v", *input.Key, err)
+	}
+	input.Metadata[metaXattrs] = aws.String(xattrSidecarValue)
+	return nil
+}
+
+// removeSidecar deletes the attribute sidecar of the stored key, once the
+// object has been replaced by one that does not use it.
+func removeSidecar(s3Client *s3.S3, bucketName, key string) error {
+	_, err := s3Client.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(bucketName),
+		Key:    aws.String(xattrSidecarPrefix + key),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to remove extended attributes sidecar of %s: %v", key, err)
+	}
+	return nil
+}
+
+// restoreXattrs reapplies the attributes recorded by attachXattrs. Attributes
+// the current user may not set (security.*, trusted.*, ACLs on filesystems
+// without ACL support) only produce a warning.
+func restoreXattrs(s3Client *s3.S3, bucketName, s3Key, localPath string, meta map[string]*string) error {
+	value, ok := metaValue(meta, metaXattrs)
+	if !ok {
+		return nil
+	}
+
+	var encoded []byte
+	if value == xattrSidecarValue {
+		sidecar := &s3.GetObjectInput{
+			Bucket: aws.String(bucketName),
+			Key:    aws.String(xattrSidecarPrefix + remoteKey(s3Key)),
+		}
+		applySSEToGet(sidecar)
+
+		output, err := s3Client.GetObject(sidecar)
+		if err != nil {
+			return fmt.Errorf("failed to fetch extended attributes for %s: %v", s3Key, err)
+		}
+		defer output.Body.Close()
+		if encoded, err = io.ReadAll(output.Body); err != nil {
+			return err
+		}
+	} else {
+		var err error
+		if encoded, err = base64.StdEncoding.DecodeString(value); err != nil {
+			return fmt.Errorf("invalid %s metadata on %s: %v", metaXattrs, s3Key, err)
+		}
+	}
+
+	var attrs map[string][]byte
+	if err := json.Unmarshal(encoded, &attrs); err != nil {
+		return fmt.Errorf("invalid extended attributes for %s: %v", s3Key, err)
+	}
+
+	names := make([]string, 0, len(attrs))
+	for name := range attrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if err := writeXattr(localPath, name, attrs[name]); err != nil {
+			if err == errXattrsUnsupported {
+				return err
+			}
+			fmt.Printf("Warning: could not restore extended attribute %s on %s: %v\n", name, localPath, err)
+		}
+	}
+	return nil
+}
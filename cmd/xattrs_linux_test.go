@@ -0,0 +1,52 @@
+package cmd
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"golang.org/x/sys/unix"
+)
+
+func TestXattrsInlineRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "labelled.dat")
+	dst := filepath.Join(dir, "restored.dat")
+	os.WriteFile(src, []byte("data"), 0644)
+	os.WriteFile(dst, []byte("data"), 0644)
+
+	if err := unix.Lsetxattr(src, "user.classification", []byte("restricted"), 0); err != nil {
+		t.Skipf("Filesystem does not support user xattrs: %v", err)
+	}
+
+	input := &s3.PutObjectInput{
+		Bucket:   aws.String("test-bucket"),
+		Key:      aws.String("labelled.dat"),
+		Metadata: map[string]*string{},
+	}
+	if err := attachXattrs(nil, input, src); err != nil {
+		t.Fatalf("attachXattrs failed: %v", err)
+	}
+	if value, _ := metaValue(input.Metadata, metaXattrs); value == "" || value == xattrSidecarValue {
+		t.Fatalf("Expected attributes inline in metadata, got %q", value)
+	}
+
+	returned := map[string]*string{}
+	for key, value := range input.Metadata {
+		returned[http.CanonicalHeaderKey(key)] = value
+	}
+	if err := restoreXattrs(nil, "test-bucket", "labelled.dat", dst, returned); err != nil {
+		t.Fatalf("restoreXattrs failed: %v", err)
+	}
+
+	value, err := readXattr(dst, "user.classification")
+	if err != nil {
+		t.Fatalf("Attribute was not restored: %v", err)
+	}
+	if string(value) != "restricted" {
+		t.Errorf("Expected restored value %q, got %q", "restricted", value)
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package cmd
+
+func readXattrs(path string) (map[string][]byte, error) {
+	return nil, errXattrsUnsupported
+}
+
+func writeXattr(path, name string, value []byte) error {
+	return errXattrsUnsupported
+}